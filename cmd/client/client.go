@@ -3,69 +3,160 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"flag"
+	"fmt"
 	"io"
 	"log/slog"
-	"net"
+	"net/netip"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/Asutorufa/tunnel/pkg/accesslog"
 	"github.com/Asutorufa/tunnel/pkg/api"
+	"github.com/Asutorufa/tunnel/pkg/auth"
 	tunnelclient "github.com/Asutorufa/tunnel/pkg/client"
+	"github.com/Asutorufa/tunnel/pkg/config"
+	"github.com/Asutorufa/tunnel/pkg/control"
+	"github.com/Asutorufa/tunnel/pkg/fakedns"
+	"github.com/Asutorufa/tunnel/pkg/forward"
 	"github.com/Asutorufa/tunnel/pkg/protomsg"
+	"github.com/Asutorufa/tunnel/pkg/route"
+	"github.com/Asutorufa/tunnel/pkg/tun"
+	"github.com/Asutorufa/tunnel/pkg/upstream"
 	"github.com/Asutorufa/yuhaiin/pkg/net/netapi"
-	"github.com/Asutorufa/yuhaiin/pkg/net/proxy/socks5"
 )
 
 func main() {
-	slog.SetLogLoggerLevel(slog.LevelDebug)
-	uuid := flag.String("uuid", "uuid", "uuid, -uuid xedsfd")
-	server := flag.String("s", "127.0.0.1:8388", "server, -s 127.0.0.1:8388")
-	socks5host := flag.String("s5", "", "socks5 proxy, -s5 127.0.0.1:1080")
-	rule := flag.String("r", "rule.json", "rules, -r config.json")
-	socks5server := flag.String("s5server", "127.0.0.1:1081", "socks5 server, -s5server 127.0.0.1:1081")
-	flag.Parse()
-
-	var ruleT map[string]protomsg.Target
-	data, err := os.ReadFile(*rule)
-	if err == nil {
-		if err := json.Unmarshal(data, &ruleT); err != nil {
-			slog.Error("unmarshal rule", "err", err)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "connect":
+			os.Exit(connect(os.Args[2:]))
+		case "validate":
+			os.Exit(forward.ValidateCommand("client", os.Args[2:]))
+		case "config":
+			os.Exit(dumpConfig(os.Args[2:]))
+		case "status", "streams", "forward", "reconnect", "log-level":
+			os.Exit(ctl(os.Args[1], os.Args[2:]))
 		}
-	} else {
-		slog.Error("read rule failed", "err", err)
 	}
 
-	var p netapi.Proxy
-	host, port, err := net.SplitHostPort(*socks5host)
+	cfg := loadConfig("client", os.Args[1:])
+
+	level, err := cfg.Log.SlogLevel()
 	if err != nil {
-		slog.Error("split proxy host port", "err", err)
-	} else {
-		p = socks5.Dial(host, port, "", "")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(level)
+	slog.SetLogLoggerLevel(level)
+
+	rules, err := forward.LoadRules(cfg.Forward.Rules, cfg.Forward.File)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
+	cfg.Limits.Apply(rules)
 
+	tlsConfig, err := cfg.TLS.ClientConfig(cfg.Server)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	egress, egressProxies := loadEgress(cfg.Device.Egress)
 	c := &tunnelclient.Client{
-		UUID:     *uuid,
-		Server:   *server,
-		S5Dialer: p,
-		PongChan: make(chan struct{}, 5),
+		UUID:     cfg.UUID,
+		Server:   cfg.Server,
+		S5Dialer: serverProxy(cfg.Server, cfg.Socks5, cfg.Proxies),
+		TLS:      tlsConfig,
+		Keepalive: protomsg.KeepaliveConfig{
+			Interval: time.Duration(cfg.Keepalive.Interval),
+			Timeout:  time.Duration(cfg.Keepalive.Timeout),
+		},
+		AccessLog:     openAccessLog(cfg.AccessLog.File, cfg.AccessLog.MaxSize, cfg.AccessLog.MaxBackups),
+		Routes:        parseAdvertiseRoutes(cfg.Device.Routes),
+		Sockets:       cfg.Device.UnixSockets,
+		Egress:        egress,
+		EgressProxies: egressProxies,
+		ExitNode:      cfg.Device.ExitNode,
+		ExitPolicy:    loadRoutes(cfg.Device.ExitPolicy),
+	}
+
+	tunnel := api.WithAccessLog(c, c.AccessLog)
+	creds := loadCredentials(cfg.Proxy.Auth)
+	dialer := &api.Dialer{
+		Tunnel:   tunnel,
+		Naming:   api.Naming{Suffix: cfg.Proxy.Suffix},
+		Direct:   cfg.Proxy.Direct,
+		Routes:   loadRoutes(cfg.Proxy.Routes),
+		Upstream: proxyChain(cfg.Proxy.Upstream),
+		Exit:     cfg.Proxy.ExitNode,
+	}
+
+	var dns *fakedns.Server
+	if cfg.DNS.Listen != "" || cfg.TUN.Name != "" {
+		dns = newDNS(cfg.DNS.Upstream, cfg.DNS.FakeIP, dialer.Naming)
 	}
 
-	s, err := api.Socks5Server(*socks5server, c)
+	if dns != nil {
+		dialer.FakeIP = dns.Pool
+	}
+
+	if cfg.DNS.Listen != "" && dns != nil {
+		go func() {
+			if err := dns.ListenAndServe(cfg.DNS.Listen); err != nil {
+				slog.Error("dns server failed", "err", err)
+			}
+		}()
+	}
+
+	if cfg.TUN.Name != "" {
+		t, err := openTUN(cfg.TUN, dns, dialer)
+		if err != nil {
+			slog.Error("open tun failed", "err", err)
+		} else {
+			defer t.Close()
+		}
+	}
+
+	s, err := api.Socks5Server(cfg.Proxy.Socks5, dialer, creds)
 	if err != nil {
 		slog.Error("new socks5server failed", "err", err)
 	} else {
 		defer s.Close()
 	}
 
-	api.Forward(c, ruleT)
+	if cfg.Proxy.HTTP != "" {
+		hs, err := api.HTTPServer(cfg.Proxy.HTTP, dialer, creds)
+		if err != nil {
+			slog.Error("new http server failed", "err", err)
+		} else {
+			defer hs.Close()
+		}
+	}
+
+	forwards := api.NewForwards(tunnel, api.ForwardRules(tunnel, rules)...)
+	defer forwards.Close()
+
+	if cfg.Control != "" {
+		cs := &control.Server{Client: c, Forwards: forwards, Level: logLevel}
+		lis, err := cs.Listen(cfg.Control)
+		if err != nil {
+			slog.Error("listen control socket failed", "err", err)
+		} else {
+			defer lis.Close()
+		}
+	}
 
 	for {
 		start := time.Now()
-		if err := c.Register(); err != nil {
-			if !errors.Is(err, io.EOF) {
-				slog.Error("register failed", "err", err)
-			}
+		err := c.Register()
+		if errors.Is(err, tunnelclient.ErrReconnect) {
+			continue
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			slog.Error("register failed", "err", err)
 		}
 
 		if time.Since(start) < time.Second*5 {
@@ -73,3 +164,183 @@ func main() {
 		}
 	}
 }
+
+// serverProxy chains -s5 and -proxy, without them HTTPS_PROXY or ALL_PROXY
+// are used.
+func serverProxy(server, socks5host string, proxies []string) netapi.Proxy {
+	if socks5host != "" {
+		proxies = append([]string{socks5host}, proxies...)
+	}
+
+	if len(proxies) == 0 {
+		p, err := upstream.FromEnvironment(server)
+		if err != nil {
+			slog.Error("parse proxy from environment failed", "err", err)
+			os.Exit(1)
+		}
+		return p
+	}
+
+	return proxyChain(proxies...)
+}
+
+func proxyChain(urls ...string) netapi.Proxy {
+	if len(urls) == 0 || urls[0] == "" {
+		return nil
+	}
+
+	p, err := upstream.ParseChain(urls...)
+	if err != nil {
+		slog.Error("parse proxy failed", "err", err)
+		os.Exit(1)
+	}
+
+	return p
+}
+
+func openAccessLog(path string, size int64, backups int) accesslog.Logger {
+	if path == "" {
+		return nil
+	}
+
+	f, err := accesslog.NewFile(path, size<<20, backups)
+	if err != nil {
+		slog.Error("open access log failed", "err", err)
+		return nil
+	}
+
+	return f
+}
+
+// loadCredentials exits when the file can't be loaded, the proxy servers
+// must not fall back to no auth.
+func loadCredentials(path string) *auth.Credentials {
+	if path == "" {
+		return nil
+	}
+
+	creds, err := auth.Load(path)
+	if err != nil {
+		slog.Error("load credentials failed", "err", err)
+		os.Exit(1)
+	}
+
+	return creds
+}
+
+func loadRoutes(path string) *route.Table {
+	if path == "" {
+		return nil
+	}
+
+	routes, err := route.Load(path)
+	if err != nil {
+		slog.Error("load routes failed", "err", err)
+		os.Exit(1)
+	}
+
+	return routes
+}
+
+func parseAdvertiseRoutes(routes []string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, r := range routes {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(r)
+		if err != nil {
+			slog.Error("parse advertised route failed", "err", err)
+			os.Exit(1)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+// egressConfig is a routes file with the proxy chains its rules use by via.
+type egressConfig struct {
+	route.Table
+	Proxies map[string][]string `json:"proxies"`
+}
+
+func loadEgress(path string) (*route.Table, map[string]netapi.Proxy) {
+	if path == "" {
+		return nil, nil
+	}
+
+	var egress egressConfig
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &egress)
+	}
+	if err == nil {
+		err = egress.Compile()
+	}
+	if err != nil {
+		slog.Error("load egress rules failed", "err", err)
+		os.Exit(1)
+	}
+
+	proxies := make(map[string]netapi.Proxy, len(egress.Proxies))
+	for name, urls := range egress.Proxies {
+		p, err := upstream.ParseChain(urls...)
+		if err != nil {
+			slog.Error("parse egress proxy failed", "name", name, "err", err)
+			os.Exit(1)
+		}
+		proxies[name] = p
+	}
+
+	return &egress.Table, proxies
+}
+
+func newDNS(upstream, prefix string, naming api.Naming) *fakedns.Server {
+	if naming.Suffix == "" {
+		slog.Error("fake ip dns needs a naming suffix")
+		return nil
+	}
+
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		slog.Error("parse fake ip range failed", "err", err)
+		return nil
+	}
+
+	pool, err := fakedns.NewPool(p)
+	if err != nil {
+		slog.Error("new fake ip pool failed", "err", err)
+		return nil
+	}
+
+	return &fakedns.Server{Pool: pool, Match: naming.Match, Upstream: upstream}
+}
+
+func openTUN(cfg config.TUN, dns *fakedns.Server, dialer *api.Dialer) (*tun.TUN, error) {
+	var subnets []tun.Subnet
+	for _, s := range cfg.Subnets {
+		subnet, err := tun.ParseSubnet(s)
+		if err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, subnet)
+	}
+
+	tunConfig := tun.Config{Name: cfg.Name, MTU: cfg.MTU, Subnets: subnets}
+
+	if dns != nil {
+		tunConfig.DNS = dns
+		tunConfig.Routes = append(tunConfig.Routes, dns.Pool.Prefix())
+
+		if cfg.DNS != "" {
+			addr, err := netip.ParseAddr(cfg.DNS)
+			if err != nil {
+				return nil, err
+			}
+			tunConfig.Routes = append(tunConfig.Routes, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+
+	return tun.Open(tunConfig, dialer)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Asutorufa/tunnel/pkg/control"
+	"github.com/Asutorufa/tunnel/pkg/forward"
+)
+
+// ctl runs a command against the control socket of a running client:
+//
+//	client status
+//	client streams
+//	client forward list
+//	client forward add [flags] <listen> <device> <[host:]port|unix:name>
+//	client forward remove <listen>
+//	client reconnect
+//	client log-level [level]
+func ctl(command string, args []string) int {
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	path := fs.String("control", control.DefaultPath(), "control socket of the running client, -control /run/tunnel-client.sock")
+	asJSON := fs.Bool("json", false, "print json, -json")
+
+	var sub string
+	if command == "forward" {
+		if len(args) == 0 {
+			fmt.Fprintln(os.Stderr, "usage: client forward <list|add|remove> [flags]")
+			return 2
+		}
+		sub, args = args[0], args[1:]
+	}
+
+	var rule forward.Rule
+	if sub == "add" {
+		fs.StringVar(&rule.Network, "network", "", "tcp, udp or unix, a unix: target is unix, -network udp")
+		fs.StringVar(&rule.Description, "description", "", "description of the rule, -description ssh")
+		fs.DurationVar((*time.Duration)(&rule.DialTimeout), "dial-timeout", 0, "timeout to open a stream, -dial-timeout 5s")
+		fs.DurationVar((*time.Duration)(&rule.IdleTimeout), "idle-timeout", 0, "close streams without traffic, -idle-timeout 30m")
+		fs.Func("bandwidth", "bytes per second of all streams of the rule, -bandwidth 1M", func(v string) error {
+			size, err := forward.ParseSize(v)
+			rule.Bandwidth = size
+			return err
+		})
+		fs.StringVar(&rule.ProxyProtocol, "proxy-protocol", "", "send a PROXY protocol header, v1 or v2, -proxy-protocol v1")
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	c := control.NewClient(*path)
+	show := func(v any, text func()) int {
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			_ = enc.Encode(v)
+		} else {
+			text()
+		}
+		return 0
+	}
+	fail := func(err error) int {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	switch command + " " + sub {
+	case "status ":
+		st, err := c.Status()
+		if err != nil {
+			return fail(err)
+		}
+		return show(st, func() {
+			fmt.Printf("uuid:       %s\nserver:     %s\n", st.UUID, st.Server)
+			if st.ServerVersion != "" {
+				fmt.Printf("version:    server %s, protocol %d, features %s\n", st.ServerVersion, st.Protocol, st.Features)
+			}
+			if !st.Registered {
+				fmt.Println("registered: no")
+			} else {
+				fmt.Printf("registered: since %s (%s)\n", st.Since.Format(time.RFC3339), time.Since(st.Since).Round(time.Second))
+				fmt.Printf("rtt:        %s, srtt %s, jitter %s\n", st.Keepalive.RTT, st.Keepalive.SRTT, st.Keepalive.Jitter)
+				fmt.Printf("pings:      %d sent, %d received, %d lost\n", st.Keepalive.Sent, st.Keepalive.Received, st.Keepalive.Lost)
+			}
+			fmt.Printf("streams:    %d\n", st.Streams)
+		})
+
+	case "streams ":
+		list, err := c.Streams()
+		if err != nil {
+			return fail(err)
+		}
+		return show(list, func() {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tDIRECTION\tDEVICE\tTARGET\tAGE")
+			for _, s := range list {
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", s.ID, s.Direction, s.Device, s.Target, time.Since(s.Start).Round(time.Second))
+			}
+			w.Flush()
+		})
+
+	case "forward list":
+		list, err := c.Forwards()
+		if err != nil {
+			return fail(err)
+		}
+		return show(list, func() {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "LISTEN\tNETWORK\tTARGET\tACTIVE\tTOTAL\tDESCRIPTION")
+			for _, f := range list {
+				network := f.Rule.Network
+				if network == "" {
+					network = forward.NetworkTCP
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", f.Addr, network, f.Rule.UUID+" "+targetOf(f.Rule), f.Active, f.Total, f.Rule.Description)
+			}
+			w.Flush()
+		})
+
+	case "forward add":
+		if fs.NArg() != 3 {
+			fmt.Fprintln(os.Stderr, "usage: client forward add [flags] <listen> <device> <[host:]port|unix:name>")
+			return 2
+		}
+
+		rule.Listen, rule.UUID = fs.Arg(0), fs.Arg(1)
+		if name, ok := strings.CutPrefix(fs.Arg(2), "unix:"); ok {
+			rule.Network, rule.Address = forward.NetworkUnix, name
+		} else {
+			address, port, err := splitTarget(fs.Arg(2))
+			if err != nil {
+				return fail(err)
+			}
+			rule.Address, rule.Port = address, port
+		}
+
+		f, err := c.AddForward(rule)
+		if err != nil {
+			return fail(err)
+		}
+		return show(f, func() { fmt.Printf("forward %s to %s %s\n", f.Addr, f.Rule.UUID, targetOf(f.Rule)) })
+
+	case "forward remove":
+		if fs.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "usage: client forward remove <listen>")
+			return 2
+		}
+		if err := c.RemoveForward(fs.Arg(0)); err != nil {
+			return fail(err)
+		}
+		return 0
+
+	case "reconnect ":
+		if err := c.Reconnect(); err != nil {
+			return fail(err)
+		}
+		return 0
+
+	case "log-level ":
+		if fs.NArg() > 0 {
+			if err := c.SetLogLevel(fs.Arg(0)); err != nil {
+				return fail(err)
+			}
+		}
+		level, err := c.LogLevel()
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Println(level)
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command: %s %s\n", command, sub)
+	return 2
+}
+
+func targetOf(r forward.Rule) string {
+	t := r.Target().NewConnect().GetConnect()
+	if t.GetNetwork() == forward.NetworkUnix {
+		return t.HostPort()
+	}
+	return strings.TrimPrefix(t.HostPort(), forward.NetworkUDP+":")
+}
@@ -1,66 +1,226 @@
 package main
 
 import (
+	"cmp"
 	"context"
-	"encoding/json"
-	"flag"
+	"crypto/tls"
+	"fmt"
 	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
 	"os"
+	"time"
 
+	"github.com/Asutorufa/tunnel/pkg/accesslog"
 	"github.com/Asutorufa/tunnel/pkg/api"
+	"github.com/Asutorufa/tunnel/pkg/auth"
+	"github.com/Asutorufa/tunnel/pkg/config"
+	"github.com/Asutorufa/tunnel/pkg/events"
+	"github.com/Asutorufa/tunnel/pkg/forward"
 	"github.com/Asutorufa/tunnel/pkg/protomsg"
+	"github.com/Asutorufa/tunnel/pkg/route"
 	tunnelserver "github.com/Asutorufa/tunnel/pkg/server"
+	"github.com/Asutorufa/tunnel/pkg/upstream"
 	"github.com/Asutorufa/yuhaiin/pkg/net/dialer"
+	"github.com/Asutorufa/yuhaiin/pkg/net/netapi"
 )
 
 func main() {
-	slog.SetLogLoggerLevel(slog.LevelDebug)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(forward.ValidateCommand("server", os.Args[2:]))
+		case "config":
+			os.Exit(dumpConfig(os.Args[2:]))
+		}
+	}
 
-	host := flag.String("h", "127.0.0.1:8388", "host, -h 127.0.0.1:8388")
-	rule := flag.String("r", "rule.json", "rules, -r config.json")
-	socks5server := flag.String("s5server", "127.0.0.1:1081", "socks5 server, -s5server 127.0.0.1:1081")
-	flag.Parse()
+	cfg := loadConfig("server", os.Args[1:])
+
+	level, err := cfg.Log.SlogLevel()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	slog.SetLogLoggerLevel(level)
 
-	lis, err := dialer.ListenContext(context.TODO(), "tcp", *host)
+	lis, err := dialer.ListenContext(context.TODO(), "tcp", cfg.Listen)
 	if err != nil {
 		panic(err)
 	}
 
-	var Rule map[string]protomsg.Target
+	tlsConfig, err := cfg.TLS.ServerConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if tlsConfig != nil {
+		lis = tls.NewListener(lis, tlsConfig)
+	}
 
-	data, err := os.ReadFile(*rule)
-	if err == nil {
-		if err := json.Unmarshal(data, &Rule); err != nil {
-			slog.Error("Unmarshal rule  failed", "err", err)
-		}
-		slog.Debug("rule", "rule", Rule)
-	} else {
-		slog.Error("read rule failed", "err", err)
+	rules, err := forward.LoadRules(cfg.Forward.Rules, cfg.Forward.File)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
+	cfg.Limits.Apply(rules)
 
 	slog.Debug("new server", "host", lis.Addr())
 
 	s := tunnelserver.NewServer()
+	s.HandshakeTimeout = cmp.Or(time.Duration(cfg.Limits.HandshakeTimeout), s.HandshakeTimeout)
+	s.Keepalive = protomsg.KeepaliveConfig{
+		Interval: time.Duration(cfg.Keepalive.Interval),
+		Timeout:  time.Duration(cfg.Keepalive.Timeout),
+	}
+	s.AccessLog = openAccessLog(cfg.AccessLog.File, cfg.AccessLog.MaxSize, cfg.AccessLog.MaxBackups)
+
+	stopEvents := startEvents(s, cfg.Events)
+	defer stopEvents()
+
+	tunnel := api.WithAccessLog(s, s.AccessLog)
+	creds := loadCredentials(cfg.Proxy.Auth)
+	proxyDialer := &api.Dialer{
+		Tunnel:   tunnel,
+		Naming:   api.Naming{Suffix: cfg.Proxy.Suffix},
+		Direct:   cfg.Proxy.Direct,
+		Routes:   loadRoutes(cfg.Proxy.Routes),
+		Upstream: proxyChain(cfg.Proxy.Upstream),
+		Exit:     cfg.Proxy.ExitNode,
+	}
+
+	forwards := api.NewForwards(tunnel, api.ForwardRules(tunnel, rules)...)
+	defer forwards.Close()
 
-	api.Forward(s, Rule)
-	s5, err := api.Socks5Server(*socks5server, s)
+	s5, err := api.Socks5Server(cfg.Proxy.Socks5, proxyDialer, creds)
 	if err != nil {
 		slog.Error("new socks5 server failed", "err", err)
 	} else {
 		defer s5.Close()
 	}
 
-	for {
-		conn, err := lis.Accept()
+	if cfg.Proxy.HTTP != "" {
+		hs, err := api.HTTPServer(cfg.Proxy.HTTP, proxyDialer, creds)
 		if err != nil {
-			return
+			slog.Error("new http server failed", "err", err)
+		} else {
+			defer hs.Close()
 		}
+	}
+
+	if err := s.Serve(lis); err != nil {
+		slog.Error("serve failed", "err", err)
+	}
+}
+
+func startEvents(s *tunnelserver.Server, cfg config.Events) func() {
+	var sinks []events.Sink
+
+	if cfg.Webhook != "" {
+		sinks = append(sinks, events.NewWebhook(cfg.Webhook, cfg.WebhookSecret))
+	}
+
+	if cfg.File != "" {
+		f, err := events.NewFile(cfg.File)
+		if err != nil {
+			slog.Error("open events file failed", "err", err)
+		} else {
+			sinks = append(sinks, f)
+		}
+	}
+
+	token := cmp.Or(cfg.HTTPToken, cfg.WebhookSecret)
+	if cfg.HTTP != "" && token == "" && !isLoopback(cfg.HTTP) {
+		slog.Error("events http needs -events-http-token or -webhook-secret unless it listens on loopback", "listen", cfg.HTTP)
+	} else if cfg.HTTP != "" {
+		hub := events.NewHub(1024)
+		hub.Token = token
+		sinks = append(sinks, hub)
 
+		mux := http.NewServeMux()
+		mux.Handle("/events", hub)
 		go func() {
-			if err := s.Handle(conn); err != nil {
-				slog.Error("handle failed", "err", err)
-				conn.Close()
+			if err := http.ListenAndServe(cfg.HTTP, mux); err != nil {
+				slog.Error("serve events http failed", "err", err)
 			}
 		}()
 	}
+
+	if len(sinks) == 0 {
+		return func() {}
+	}
+
+	return events.Dispatch(s, sinks...)
+}
+
+// isLoopback reports whether a listen address only accepts local clients.
+func isLoopback(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.IsLoopback()
+}
+
+func openAccessLog(path string, size int64, backups int) accesslog.Logger {
+	if path == "" {
+		return nil
+	}
+
+	f, err := accesslog.NewFile(path, size<<20, backups)
+	if err != nil {
+		slog.Error("open access log failed", "err", err)
+		return nil
+	}
+
+	return f
+}
+
+// loadCredentials exits when the file can't be loaded, the proxy servers
+// must not fall back to no auth.
+func loadCredentials(path string) *auth.Credentials {
+	if path == "" {
+		return nil
+	}
+
+	creds, err := auth.Load(path)
+	if err != nil {
+		slog.Error("load credentials failed", "err", err)
+		os.Exit(1)
+	}
+
+	return creds
+}
+
+func loadRoutes(path string) *route.Table {
+	if path == "" {
+		return nil
+	}
+
+	routes, err := route.Load(path)
+	if err != nil {
+		slog.Error("load routes failed", "err", err)
+		os.Exit(1)
+	}
+
+	return routes
+}
+
+func proxyChain(urls ...string) netapi.Proxy {
+	if len(urls) == 0 || urls[0] == "" {
+		return nil
+	}
+
+	p, err := upstream.ParseChain(urls...)
+	if err != nil {
+		slog.Error("parse proxy failed", "err", err)
+		os.Exit(1)
+	}
+
+	return p
 }
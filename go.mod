@@ -4,7 +4,11 @@ go 1.23.3
 
 require (
 	github.com/Asutorufa/yuhaiin v0.3.8
+	golang.org/x/net v0.34.0
+	golang.org/x/sys v0.29.0
+	golang.org/x/time v0.9.0
 	google.golang.org/protobuf v1.36.5
+	gvisor.dev/gvisor v0.0.0-20241220022509-4690b2e35d70
 )
 
 require (
@@ -23,10 +27,6 @@ require (
 	golang.org/x/crypto v0.32.0 // indirect
 	golang.org/x/exp v0.0.0-20241204233417-43b7b7cde48d // indirect
 	golang.org/x/mod v0.22.0 // indirect
-	golang.org/x/net v0.34.0 // indirect
 	golang.org/x/sync v0.10.0 // indirect
-	golang.org/x/sys v0.29.0 // indirect
-	golang.org/x/time v0.9.0 // indirect
 	golang.org/x/tools v0.28.0 // indirect
-	gvisor.dev/gvisor v0.0.0-20241220022509-4690b2e35d70 // indirect
 )
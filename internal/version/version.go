@@ -0,0 +1,46 @@
+// Package version is the build of the binaries, the makefile sets it with
+// -ldflags -X.
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+var (
+	Version   = "dev"
+	GitCommit = ""
+	BuildArch = ""
+	BuildTime = ""
+)
+
+// String describes the build for -version.
+func String() string {
+	commit := GitCommit
+	if commit == "" {
+		// go build without the makefile still records the vcs revision
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, s := range info.Settings {
+				if s.Key == "vcs.revision" {
+					commit = s.Value
+				}
+			}
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "version: %s\n", Version)
+	if commit != "" {
+		fmt.Fprintf(&b, "commit:  %s\n", commit)
+	}
+	if BuildTime != "" {
+		fmt.Fprintf(&b, "built:   %s\n", BuildTime)
+	}
+	if BuildArch != "" {
+		fmt.Fprintf(&b, "arch:    %s\n", BuildArch)
+	}
+	fmt.Fprintf(&b, "go:      %s %s/%s", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return b.String()
+}
@@ -0,0 +1,201 @@
+// Package accesslog records one entry for every relayed stream: who asked
+// for it, where it went, how many bytes it carried and how it ended.
+package accesslog
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Reason string
+
+const (
+	// ReasonClosed is a stream that ended with eof or was closed by either side
+	ReasonClosed Reason = "closed"
+	// ReasonError is a stream that ended with a read or write error
+	ReasonError Reason = "error"
+	// ReasonOpenFailed is a stream that could not be opened
+	ReasonOpenFailed Reason = "open-failed"
+)
+
+// Record is one stream, bytes in are sent from the target to the requester
+// and bytes out from the requester to the target.
+type Record struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Frontend  string    `json:"frontend"`
+	Requester string    `json:"requester,omitempty"`
+	Identity  string    `json:"identity,omitempty"`
+	Device    string    `json:"device"`
+	Target    string    `json:"target"`
+	BytesIn   int64     `json:"bytes_in"`
+	BytesOut  int64     `json:"bytes_out"`
+	Reason    Reason    `json:"reason"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type Logger interface {
+	Log(Record)
+}
+
+// Source describes the requester of a stream.
+type Source struct {
+	// Frontend that accepted the stream, like socks5, forward or tunnel
+	Frontend string
+	Addr     string
+	Identity string
+}
+
+type sourceKey struct{}
+
+func WithSource(ctx context.Context, s Source) context.Context {
+	return context.WithValue(ctx, sourceKey{}, s)
+}
+
+func SourceFrom(ctx context.Context) Source {
+	s, _ := ctx.Value(sourceKey{}).(Source)
+	return s
+}
+
+// Entry collects a record from the time a stream is requested until it is
+// closed. A nil Entry does nothing, so callers don't need to check whether
+// a logger is configured.
+type Entry struct {
+	logger Logger
+	record Record
+
+	in, out atomic.Int64
+
+	mu   sync.Mutex
+	err  error
+	once sync.Once
+}
+
+// Begin starts an entry for a stream to target on device, it returns nil
+// when l is nil.
+func Begin(ctx context.Context, l Logger, device, target string) *Entry {
+	if l == nil {
+		return nil
+	}
+
+	source := SourceFrom(ctx)
+	return &Entry{
+		logger: l,
+		record: Record{
+			Start:     time.Now(),
+			Frontend:  source.Frontend,
+			Requester: source.Addr,
+			Identity:  source.Identity,
+			Device:    device,
+			Target:    target,
+		},
+	}
+}
+
+// Fail logs a stream that could not be opened.
+func (e *Entry) Fail(err error) {
+	if e == nil {
+		return
+	}
+
+	e.once.Do(func() {
+		e.record.Reason = ReasonOpenFailed
+		if err != nil {
+			e.record.Error = err.Error()
+		}
+		e.finish()
+	})
+}
+
+// WrapTarget counts the bytes of a connection to the target side of the
+// stream and logs the entry when it is closed.
+func (e *Entry) WrapTarget(c net.Conn) net.Conn {
+	if e == nil {
+		return c
+	}
+	return &conn{Conn: c, entry: e, read: &e.in, written: &e.out}
+}
+
+// WrapRequester is WrapTarget for a connection to the requester side.
+func (e *Entry) WrapRequester(c net.Conn) net.Conn {
+	if e == nil {
+		return c
+	}
+	return &conn{Conn: c, entry: e, read: &e.out, written: &e.in}
+}
+
+func (e *Entry) setError(err error) {
+	if err == nil || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return
+	}
+
+	e.mu.Lock()
+	if e.err == nil {
+		e.err = err
+	}
+	e.mu.Unlock()
+}
+
+func (e *Entry) close() {
+	e.once.Do(func() {
+		e.mu.Lock()
+		err := e.err
+		e.mu.Unlock()
+
+		e.record.Reason = ReasonClosed
+		if err != nil {
+			e.record.Reason = ReasonError
+			e.record.Error = err.Error()
+		}
+		e.finish()
+	})
+}
+
+func (e *Entry) finish() {
+	e.record.End = time.Now()
+	e.record.BytesIn = e.in.Load()
+	e.record.BytesOut = e.out.Load()
+	e.logger.Log(e.record)
+}
+
+type conn struct {
+	net.Conn
+	entry   *Entry
+	read    *atomic.Int64
+	written *atomic.Int64
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(int64(n))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		c.entry.setError(err)
+	}
+	return n, err
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	c.entry.setError(err)
+	return n, err
+}
+
+func (c *conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+func (c *conn) Close() error {
+	err := c.Conn.Close()
+	c.entry.close()
+	return err
+}
@@ -0,0 +1,120 @@
+package accesslog
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type records []Record
+
+func (r *records) Log(rec Record) { *r = append(*r, rec) }
+
+func TestEntry(t *testing.T) {
+	var logged records
+
+	ctx := WithSource(context.Background(), Source{Frontend: "socks5", Addr: "127.0.0.1:1000", Identity: "alice"})
+	entry := Begin(ctx, &logged, "dev1", "127.0.0.1:22")
+
+	local, remote := net.Pipe()
+	conn := entry.WrapTarget(local)
+
+	go func() {
+		_, _ = remote.Write([]byte("hello"))
+		_, _ = io.Copy(io.Discard, remote)
+	}()
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	_ = conn.Close()
+
+	if len(logged) != 1 {
+		t.Fatalf("expect one record, got %d", len(logged))
+	}
+
+	r := logged[0]
+	if r.BytesIn != 5 || r.BytesOut != 2 {
+		t.Fatalf("unexpected bytes in %d out %d", r.BytesIn, r.BytesOut)
+	}
+	if r.Reason != ReasonClosed || r.Identity != "alice" || r.Device != "dev1" || r.Frontend != "socks5" {
+		t.Fatalf("unexpected record: %+v", r)
+	}
+	if r.End.Before(r.Start) {
+		t.Fatalf("end before start: %+v", r)
+	}
+}
+
+func TestEntryFail(t *testing.T) {
+	var logged records
+
+	Begin(context.Background(), &logged, "dev1", "127.0.0.1:22").Fail(errors.New("refused"))
+
+	if len(logged) != 1 || logged[0].Reason != ReasonOpenFailed || logged[0].Error != "refused" {
+		t.Fatalf("unexpected records: %+v", logged)
+	}
+
+	var entry *Entry = Begin(context.Background(), nil, "dev1", "127.0.0.1:22")
+	entry.Fail(errors.New("nil entry"))
+}
+
+func TestFileRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.jsonl")
+
+	f, err := NewFile(path, 300, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for range 20 {
+		f.Log(Record{Device: "dev1", Target: "127.0.0.1:22", Reason: ReasonClosed})
+	}
+
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 300 {
+			t.Fatalf("%s is larger than max size: %d", p, info.Size())
+		}
+		assertRecords(t, p)
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expect at most 2 backups, got %v", err)
+	}
+}
+
+func assertRecords(t *testing.T, path string) {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var r Record
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if r.Device != "dev1" {
+			t.Fatalf("unexpected record: %+v", r)
+		}
+	}
+}
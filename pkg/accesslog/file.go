@@ -0,0 +1,123 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// File writes records as json lines and rotates the file when it grows past
+// MaxSize, path.1 is the newest backup and at most MaxBackups are kept.
+type File struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	buf  bytes.Buffer
+}
+
+func NewFile(path string, maxSize int64, maxBackups int) (*File, error) {
+	f := &File{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.f = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *File) Log(r Record) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.f == nil {
+		return
+	}
+
+	f.buf.Reset()
+	if err := json.NewEncoder(&f.buf).Encode(r); err != nil {
+		slog.Error("encode access log failed", "err", err)
+		return
+	}
+
+	if f.MaxSize > 0 && f.size > 0 && f.size+int64(f.buf.Len()) > f.MaxSize {
+		if err := f.rotate(); err != nil {
+			slog.Error("rotate access log failed", "file", f.Path, "err", err)
+			if f.f == nil {
+				return
+			}
+		}
+	}
+
+	n, err := f.f.Write(f.buf.Bytes())
+	f.size += int64(n)
+	if err != nil {
+		slog.Error("write access log failed", "file", f.Path, "err", err)
+	}
+}
+
+// rotate moves the current file to the backups, a new file is opened even
+// when moving fails so that records are not lost.
+func (f *File) rotate() error {
+	err := f.f.Close()
+	f.f = nil
+
+	if err == nil {
+		err = f.shift()
+	}
+
+	if oerr := f.open(); oerr != nil {
+		return oerr
+	}
+	return err
+}
+
+func (f *File) shift() error {
+	if f.MaxBackups <= 0 {
+		return os.Remove(f.Path)
+	}
+
+	_ = os.Remove(backup(f.Path, f.MaxBackups))
+	for i := f.MaxBackups - 1; i > 0; i-- {
+		if err := os.Rename(backup(f.Path, i), backup(f.Path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return os.Rename(f.Path, backup(f.Path, 1))
+}
+
+func backup(path string, i int) string { return fmt.Sprintf("%s.%d", path, i) }
+
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.f == nil {
+		return nil
+	}
+	err := f.f.Close()
+	f.f = nil
+	return err
+}
@@ -2,18 +2,15 @@ package api
 
 import (
 	"context"
-	"io"
 	"log/slog"
 	"net"
 	"strings"
 
+	"github.com/Asutorufa/tunnel/pkg/accesslog"
+	"github.com/Asutorufa/tunnel/pkg/auth"
 	"github.com/Asutorufa/tunnel/pkg/protomsg"
 	"github.com/Asutorufa/yuhaiin/pkg/net/netapi"
-	"github.com/Asutorufa/yuhaiin/pkg/net/proxy/simple"
-	"github.com/Asutorufa/yuhaiin/pkg/net/proxy/socks5"
-	"github.com/Asutorufa/yuhaiin/pkg/protos/config/listener"
 	"github.com/Asutorufa/yuhaiin/pkg/utils/relay"
-	"google.golang.org/protobuf/proto"
 )
 
 type Tunnel interface {
@@ -21,101 +18,59 @@ type Tunnel interface {
 	Close() error
 }
 
-func Forward(api Tunnel, Rule map[string]protomsg.Target) {
-	for h, v := range Rule {
-		go func(h string, v protomsg.Target) {
-			if err := forward(api, h, v); err != nil {
-				slog.Error("forward failed", "host", h, "target", v, "err", err)
-			}
-		}(h, v)
+// WithAccessLog logs every stream opened through t, the requester is read
+// from the accesslog source of the context.
+func WithAccessLog(t Tunnel, l accesslog.Logger) Tunnel {
+	if l == nil {
+		return t
 	}
+	return &logTunnel{Tunnel: t, logger: l}
 }
 
-func forward(api Tunnel, host string, t protomsg.Target) error {
-	lis, err := net.Listen("tcp", host)
+type logTunnel struct {
+	Tunnel
+	logger accesslog.Logger
+}
+
+func (t *logTunnel) OpenStream(ctx context.Context, req *protomsg.Request) (net.Conn, error) {
+	entry := accesslog.Begin(ctx, t.logger, req.GetConnect().GetTarget(), req.GetConnect().HostPort())
+
+	conn, err := t.Tunnel.OpenStream(ctx, req)
 	if err != nil {
-		return err
+		entry.Fail(err)
+		return nil, err
 	}
 
-	slog.Debug("new server", "host", lis.Addr(), "target", t)
-
-	for {
-		conn, err := lis.Accept()
-		if err != nil {
-			return err
-		}
-
-		go func() {
-			defer conn.Close()
-
-			remote, err := api.OpenStream(context.TODO(), &protomsg.Request{
-				Type: protomsg.Type_Connection,
-				Payload: &protomsg.Request_Connect{
-					Connect: &protomsg.Connect{
-						Target:  t.UUID,
-						Address: t.Address,
-						Port:    uint32(t.Port),
-					},
-				},
-			})
-			if err != nil {
-				slog.Error("open  stream failed", "host", host, "target", t, "err", err)
-				return
-			}
-			defer remote.Close()
-
-			relay.Relay(remote, conn)
-		}()
-	}
+	return entry.WrapTarget(conn), nil
 }
 
-type HandlerFunc func(*netapi.StreamMeta)
+// withAuth rejects streams that the identity of the context may not open.
+func withAuth(t Tunnel, creds *auth.Credentials) Tunnel {
+	if creds == nil {
+		return t
+	}
+	return &authTunnel{t}
+}
 
-func (h HandlerFunc) HandleStream(s *netapi.StreamMeta) { h(s) }
-func (h HandlerFunc) HandlePacket(*netapi.Packet)       {}
+type authTunnel struct{ Tunnel }
 
-func Socks5Server(host string, api Tunnel) (io.Closer, error) {
-	lis, err := simple.NewServer(listener.Tcpudp_builder{
-		Host: proto.String(host),
-	}.Build())
-	if err != nil {
+func (t *authTunnel) OpenStream(ctx context.Context, req *protomsg.Request) (net.Conn, error) {
+	connect := req.GetConnect()
+	if err := auth.IdentityFrom(ctx).Check(connect.GetTarget(), uint16(connect.GetPort())); err != nil {
 		return nil, err
 	}
+	return t.Tunnel.OpenStream(ctx, req)
+}
 
-	server, err := socks5.NewServer(listener.Socks5_builder{
-		Udp: proto.Bool(false),
-	}.Build(), lis, HandlerFunc(func(s *netapi.StreamMeta) {
-		go Stream(context.TODO(), api, s)
-	}))
-	if err != nil {
-		return nil, err
-	}
+type HandlerFunc func(*netapi.StreamMeta)
 
-	return server, nil
-}
+func (h HandlerFunc) HandleStream(s *netapi.StreamMeta) { h(s) }
+func (h HandlerFunc) HandlePacket(*netapi.Packet)       {}
 
-func Stream(ctx context.Context, api Tunnel, t *netapi.StreamMeta) {
+func Stream(ctx context.Context, d *Dialer, t *netapi.StreamMeta) {
 	defer t.Src.Close()
 
-	var address, device string
-	if i := strings.LastIndexByte(t.Address.Hostname(), '.'); i != -1 {
-		address = t.Address.Hostname()[:i]
-		device = t.Address.Hostname()[i+1:]
-	} else {
-		address = "127.0.0.1"
-		device = t.Address.Hostname()
-	}
-
-	conn, err := api.OpenStream(ctx, &protomsg.Request{
-		Type: protomsg.Type_Connection,
-		Payload: &protomsg.Request_Connect{
-			Connect: &protomsg.Connect{
-				Target:  device,
-				Address: address,
-				Port:    uint32(t.Address.Port()),
-			},
-		},
-	})
+	conn, err := d.dial(ctx, t.Address.Hostname(), t.Address.Port())
 	if err != nil {
 		slog.Error("open stream failed", "target", t, "err", err)
 		return
@@ -125,3 +80,13 @@ func Stream(ctx context.Context, api Tunnel, t *netapi.StreamMeta) {
 
 	relay.Relay(conn, t.Src)
 }
+
+// SplitHostname splits legacy "address.device" names into the target address
+// and device, a bare device name targets 127.0.0.1 on the device.
+func SplitHostname(hostname string) (address, device string) {
+	if i := strings.LastIndexByte(hostname, '.'); i != -1 {
+		return hostname[:i], hostname[i+1:]
+	}
+
+	return "127.0.0.1", hostname
+}
@@ -0,0 +1,184 @@
+package api_test
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/Asutorufa/tunnel/pkg/api"
+	"github.com/Asutorufa/tunnel/pkg/auth"
+	tunnelclient "github.com/Asutorufa/tunnel/pkg/client"
+	"github.com/Asutorufa/tunnel/pkg/forward"
+	"github.com/Asutorufa/tunnel/pkg/protomsg"
+	"github.com/Asutorufa/tunnel/pkg/tunneltest"
+	"github.com/Asutorufa/yuhaiin/pkg/net/netapi"
+	"github.com/Asutorufa/yuhaiin/pkg/net/proxy/socks5"
+	"golang.org/x/net/proxy"
+)
+
+func TestForward(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	h.NewDevice("dev1")
+	port := tunneltest.EchoServer(t)
+
+	for _, tunnel := range []api.Tunnel{h.Server, h.NewClient("requester")} {
+		host := tunneltest.FreeAddr(t)
+		api.Forward(tunnel, map[string]protomsg.Target{
+			host: {UUID: "dev1", Address: "127.0.0.1", Port: port},
+		})
+
+		var conn net.Conn
+		tunneltest.Eventually(t, func() bool {
+			var err error
+			conn, err = net.Dial("tcp", host)
+			return err == nil
+		}, "forward listen on %s", host)
+
+		tunneltest.AssertEcho(t, conn)
+		conn.Close()
+	}
+}
+
+func TestForwardUnixInUse(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	h.NewDevice("dev1")
+	port := tunneltest.EchoServer(t)
+
+	path := filepath.Join(t.TempDir(), "forward.sock")
+	forwards := api.NewForwards(h.Server)
+	defer forwards.Close()
+
+	rule := forward.Rule{Listen: "unix:" + path, UUID: "dev1", Address: "127.0.0.1", Port: port}
+	if _, err := forwards.Add(rule); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := forwards.Add(rule); err == nil {
+		t.Fatal("expect a second rule on the same unix socket refused")
+	}
+
+	// another process serving the socket keeps it
+	if _, err := api.ForwardRule(h.Server, rule); err == nil {
+		t.Fatal("expect a socket in use not taken over")
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tunneltest.AssertEcho(t, conn)
+}
+
+func TestForwardUnix(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	path := tunneltest.UnixEchoServer(t)
+	h.NewDevice("dev1", func(c *tunnelclient.Client) {
+		c.Sockets = map[string]string{"echo": path}
+	})
+	port := tunneltest.EchoServer(t)
+
+	// a socket file left by a previous run
+	unixHost := filepath.Join(t.TempDir(), "forward.sock")
+	stale, err := net.Listen("unix", unixHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	tcpHost := tunneltest.FreeAddr(t)
+	api.Forward(h.Server, map[string]protomsg.Target{
+		"unix:" + unixHost: {UUID: "dev1", Address: "127.0.0.1", Port: port},
+		tcpHost:            {UUID: "dev1", Address: "echo", Network: protomsg.NetworkUnix},
+	})
+
+	for _, addr := range [][2]string{{"unix", unixHost}, {"tcp", tcpHost}} {
+		var conn net.Conn
+		tunneltest.Eventually(t, func() bool {
+			var err error
+			conn, err = net.Dial(addr[0], addr[1])
+			return err == nil
+		}, "forward listen on %s", addr[1])
+
+		tunneltest.AssertEcho(t, conn)
+		conn.Close()
+	}
+}
+
+func TestSocks5Server(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	h.NewDevice("dev1")
+	port := tunneltest.EchoServer(t)
+
+	for _, tunnel := range []api.Tunnel{h.Server, h.NewClient("requester")} {
+		host := tunneltest.FreeAddr(t)
+		s, err := api.Socks5Server(host, api.NewDialer(tunnel), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		shost, sport, _ := net.SplitHostPort(host)
+		target, err := netapi.ParseAddress("tcp", net.JoinHostPort("127.0.0.1.dev1.tunnel", strconv.Itoa(int(port))))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := socks5.Dial(shost, sport, "", "").Conn(context.Background(), target)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tunneltest.AssertEcho(t, conn)
+		conn.Close()
+	}
+}
+
+func TestSocks5ServerAuth(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	h.NewDevice("dev1")
+	port := tunneltest.EchoServer(t)
+
+	creds, err := auth.New(
+		auth.User{Username: "alice", Password: "secret", Allow: []string{"dev1:" + strconv.Itoa(int(port))}},
+		auth.User{Username: "bob", Password: "secret", Allow: []string{"dev2"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host := tunneltest.FreeAddr(t)
+	s, err := api.Socks5Server(host, api.NewDialer(h.Server), creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	target := net.JoinHostPort("127.0.0.1.dev1.tunnel", strconv.Itoa(int(port)))
+
+	for _, user := range []*proxy.Auth{nil, {User: "alice", Password: "wrong"}, {User: "bob", Password: "secret"}} {
+		d, err := proxy.SOCKS5("tcp", host, user, proxy.Direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn, err := d.Dial("tcp", target); err == nil {
+			conn.Close()
+			t.Fatalf("expect %v to be rejected", user)
+		}
+	}
+
+	d, err := proxy.SOCKS5("tcp", host, &proxy.Auth{User: "alice", Password: "secret"}, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := d.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tunneltest.AssertEcho(t, conn)
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/Asutorufa/tunnel/pkg/auth"
+	"github.com/Asutorufa/tunnel/pkg/fakedns"
+	"github.com/Asutorufa/tunnel/pkg/protomsg"
+	"github.com/Asutorufa/tunnel/pkg/route"
+	"github.com/Asutorufa/yuhaiin/pkg/net/netapi"
+)
+
+var _ netapi.Proxy = (*Dialer)(nil)
+
+var ErrRejected = errors.New("rejected by route")
+
+// Dialer dials "host.device.tunnel:port" through a Tunnel, it can be used as
+// http.Transport.DialContext, a grpc context dialer or a yuhaiin netapi.Proxy.
+type Dialer struct {
+	Tunnel Tunnel
+	Naming Naming
+	// Direct dials names outside the naming scheme without the tunnel,
+	// they fail with ErrNotTunnelName otherwise
+	Direct bool
+	// Routes picks the tunnel, direct, the upstream proxy or reject for
+	// every destination, it replaces Direct when it is set
+	Routes *route.Table
+	// Upstream dials the destinations routed to the proxy
+	Upstream netapi.Proxy
+	// FakeIP maps addresses answered by the fake dns server back to names
+	FakeIP *fakedns.Pool
+	// Exit is the uuid of an exit node device, names outside the naming
+	// scheme are opened through it instead of failing or dialing directly.
+	// Plain ips in prefixes advertised by devices still go to those devices.
+	Exit string
+}
+
+func NewDialer(t Tunnel) *Dialer { return &Dialer{Tunnel: t, Naming: DefaultNaming} }
+
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network: %s", network)
+	}
+
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q: %w", portStr, err)
+	}
+
+	return d.dial(ctx, host, uint16(port))
+}
+
+func (d *Dialer) dial(ctx context.Context, hostname string, port uint16) (net.Conn, error) {
+	if d.FakeIP != nil {
+		name, err := d.fakeName(hostname)
+		if err != nil {
+			return nil, err
+		}
+		hostname = name
+	}
+
+	address := net.JoinHostPort(strings.Trim(hostname, "[]"), strconv.Itoa(int(port)))
+
+	action := route.Tunnel
+	if d.Routes != nil {
+		action = d.Routes.Match(hostname, port)
+	}
+
+	switch action {
+	case route.Direct:
+		var nd net.Dialer
+		return nd.DialContext(ctx, "tcp", address)
+	case route.Proxy:
+		if d.Upstream == nil {
+			return nil, fmt.Errorf("no upstream proxy for %s", address)
+		}
+		addr, err := netapi.ParseAddress("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		return d.Upstream.Conn(ctx, addr)
+	case route.Reject:
+		return nil, fmt.Errorf("%w: %s", ErrRejected, address)
+	}
+
+	target, err := d.Naming.Parse(hostname, port)
+	if errors.Is(err, ErrNotTunnelName) && d.Exit != "" {
+		req := protomsg.NewConnect(d.Exit, strings.Trim(hostname, "[]"), port)
+		req.GetConnect().Ack = true
+		req.GetConnect().Exit = true
+		return d.Tunnel.OpenStream(ctx, req)
+	}
+	if errors.Is(err, ErrNotTunnelName) && d.Direct && d.Routes == nil {
+		var nd net.Dialer
+		return nd.DialContext(ctx, "tcp", address)
+	}
+	if errors.Is(err, ErrNotTunnelName) {
+		// a plain ip goes to the device advertising a route to it
+		if addr, perr := netip.ParseAddr(strings.Trim(hostname, "[]")); perr == nil {
+			target, err = protomsg.Target{Address: addr.String(), Port: port}, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	req := protomsg.NewConnect(target.UUID, target.Address, target.Port)
+	req.GetConnect().Ack = true
+
+	return d.Tunnel.OpenStream(ctx, req)
+}
+
+func (d *Dialer) fakeName(hostname string) (string, error) {
+	addr, err := netip.ParseAddr(strings.Trim(hostname, "[]"))
+	if err != nil || !d.FakeIP.Contains(addr) {
+		return hostname, nil
+	}
+
+	name, ok := d.FakeIP.Name(addr)
+	if !ok {
+		return "", fmt.Errorf("fake ip %s is not assigned to a name", addr)
+	}
+	return name, nil
+}
+
+func (d *Dialer) Conn(ctx context.Context, addr netapi.Address) (net.Conn, error) {
+	return d.dial(ctx, addr.Hostname(), addr.Port())
+}
+
+func (d *Dialer) PacketConn(context.Context, netapi.Address) (net.PacketConn, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (d *Dialer) Dispatch(_ context.Context, addr netapi.Address) (netapi.Address, error) {
+	return addr, nil
+}
+
+func (d *Dialer) Close() error { return nil }
+
+// withAuth returns a copy of the dialer that checks the identity of the
+// context before a stream is opened.
+func (d *Dialer) withAuth(creds *auth.Credentials) *Dialer {
+	c := *d
+	c.Tunnel = withAuth(d.Tunnel, creds)
+	return &c
+}
@@ -0,0 +1,197 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/Asutorufa/tunnel/pkg/fakedns"
+	"github.com/Asutorufa/tunnel/pkg/protomsg"
+	"github.com/Asutorufa/tunnel/pkg/route"
+	"github.com/Asutorufa/yuhaiin/pkg/net/netapi"
+)
+
+type recordTunnel struct {
+	req *protomsg.Request
+}
+
+func (r *recordTunnel) OpenStream(_ context.Context, req *protomsg.Request) (net.Conn, error) {
+	r.req = req
+	c1, c2 := net.Pipe()
+	_ = c2.Close()
+	return c1, nil
+}
+
+func (r *recordTunnel) Close() error { return nil }
+
+func TestDialer(t *testing.T) {
+	for _, tt := range []struct {
+		address string
+		device  string
+		host    string
+		port    uint32
+	}{
+		{"dev1.tunnel:22", "dev1", "127.0.0.1", 22},
+		{"db.internal.dev1.tunnel:5432", "dev1", "db.internal", 5432},
+		{"192.168.1.1.dev2.tunnel:80", "dev2", "192.168.1.1", 80},
+		// routed by the server to the device advertising the address
+		{"192.168.1.1:80", "", "192.168.1.1", 80},
+		{"[fd00::1]:80", "", "fd00::1", 80},
+	} {
+		rt := &recordTunnel{}
+		conn, err := NewDialer(rt).DialContext(context.Background(), "tcp", tt.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+
+		c := rt.req.GetConnect()
+		if c.GetTarget() != tt.device || c.GetAddress() != tt.host || c.GetPort() != tt.port || !c.GetAck() {
+			t.Errorf("%s: got %v", tt.address, c)
+		}
+	}
+
+	if _, err := NewDialer(&recordTunnel{}).Dial("udp", "dev1.tunnel:53"); err == nil {
+		t.Error("udp should be unsupported")
+	}
+
+	if _, err := NewDialer(&recordTunnel{}).Dial("tcp", "dev1:22"); !errors.Is(err, ErrNotTunnelName) {
+		t.Errorf("expect not a tunnel name, got %v", err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	rt := &recordTunnel{}
+	conn, err := (&Dialer{Tunnel: rt, Naming: DefaultNaming, Direct: true}).Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if rt.req != nil {
+		t.Errorf("direct name should not use the tunnel: %v", rt.req)
+	}
+}
+
+type recordProxy struct {
+	Dialer
+	addr netapi.Address
+}
+
+func (r *recordProxy) Conn(_ context.Context, addr netapi.Address) (net.Conn, error) {
+	r.addr = addr
+	c1, c2 := net.Pipe()
+	_ = c2.Close()
+	return c1, nil
+}
+
+func TestDialerRoutes(t *testing.T) {
+	routes, err := route.Parse([]byte(`{
+		"rules": [
+			{"suffix": "tunnel", "action": "tunnel"},
+			{"cidr": "127.0.0.0/8", "action": "direct"},
+			{"port": "25", "action": "reject"}
+		],
+		"default": "proxy"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt, upstream := &recordTunnel{}, &recordProxy{}
+	d := &Dialer{Tunnel: rt, Naming: DefaultNaming, Routes: routes, Upstream: upstream}
+
+	conn, err := d.Dial("tcp", "dev1.tunnel:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if rt.req.GetConnect().GetTarget() != "dev1" {
+		t.Errorf("expect tunnel stream, got %v", rt.req)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	conn, err = d.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	conn, err = d.Dial("tcp", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if upstream.addr == nil || upstream.addr.String() != "example.com:443" {
+		t.Errorf("expect example.com:443 through the upstream, got %v", upstream.addr)
+	}
+
+	if _, err := d.Dial("tcp", "example.com:25"); !errors.Is(err, ErrRejected) {
+		t.Errorf("expect rejected, got %v", err)
+	}
+
+	d.Upstream = nil
+	if _, err := d.Dial("tcp", "example.com:443"); err == nil {
+		t.Error("proxy route without upstream should fail")
+	}
+}
+
+func TestDialerFakeIP(t *testing.T) {
+	pool, err := fakedns.NewPool(fakedns.DefaultPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt := &recordTunnel{}
+	d := &Dialer{Tunnel: rt, Naming: DefaultNaming, FakeIP: pool}
+
+	addr := pool.Addr("db.dev1.tunnel")
+	conn, err := d.Dial("tcp", net.JoinHostPort(addr.String(), "5432"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if c := rt.req.GetConnect(); c.GetTarget() != "dev1" || c.GetAddress() != "db" || c.GetPort() != 5432 {
+		t.Errorf("unexpected connect %v", c)
+	}
+
+	if _, err := d.Dial("tcp", "198.18.255.1:22"); err == nil {
+		t.Error("unassigned fake ip should fail")
+	}
+}
+
+func TestDialerExit(t *testing.T) {
+	for _, tt := range []struct {
+		address string
+		device  string
+		host    string
+		exit    bool
+	}{
+		{"example.com:443", "exit1", "example.com", true},
+		{"[2001:db8::1]:443", "exit1", "2001:db8::1", true},
+		{"dev1.tunnel:443", "dev1", "127.0.0.1", false},
+	} {
+		rt := &recordTunnel{}
+		d := &Dialer{Tunnel: rt, Naming: DefaultNaming, Direct: true, Exit: "exit1"}
+		conn, err := d.Dial("tcp", tt.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+
+		c := rt.req.GetConnect()
+		if c.GetTarget() != tt.device || c.GetAddress() != tt.host || c.GetExit() != tt.exit || !c.GetAck() {
+			t.Errorf("%s: got %v", tt.address, c)
+		}
+	}
+}
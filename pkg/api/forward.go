@@ -0,0 +1,442 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Asutorufa/tunnel/pkg/accesslog"
+	"github.com/Asutorufa/tunnel/pkg/forward"
+	"github.com/Asutorufa/tunnel/pkg/protomsg"
+	"github.com/Asutorufa/yuhaiin/pkg/utils/relay"
+	"golang.org/x/time/rate"
+)
+
+// Forward serves rules of the old rule.json format.
+func Forward(api Tunnel, Rule map[string]protomsg.Target) {
+	ForwardRules(api, forward.FromTargets(Rule))
+}
+
+// ForwardRules serves the enabled rules, a rule that fails to listen is
+// logged and skipped.
+func ForwardRules(t Tunnel, rules []forward.Rule) []*Forwarder {
+	var fs []*Forwarder
+	for _, r := range rules {
+		if !r.IsEnabled() {
+			continue
+		}
+
+		f, err := ForwardRule(t, r)
+		if err != nil {
+			slog.Error("forward failed", "listen", r.Listen, "target", r.Target(), "err", err)
+			continue
+		}
+		fs = append(fs, f)
+	}
+	return fs
+}
+
+var ErrForwardNotFound = errors.New("no forward rule listens on the address")
+
+// Forwards are the running forward rules of a tunnel, rules can be added
+// and removed while it runs.
+type Forwards struct {
+	tunnel Tunnel
+
+	mu   sync.Mutex
+	list []*Forwarder
+}
+
+func NewForwards(t Tunnel, running ...*Forwarder) *Forwards {
+	return &Forwards{tunnel: t, list: running}
+}
+
+// Add validates r and serves it.
+func (fs *Forwards) Add(r forward.Rule) (*Forwarder, error) {
+	if errs := forward.Validate([]forward.Rule{r}); len(errs) > 0 {
+		for _, e := range errs {
+			e.Path = strings.TrimPrefix(strings.TrimPrefix(e.Path, "rules[0]"), ".")
+		}
+		return nil, errs
+	}
+	if !r.IsEnabled() {
+		return nil, errors.New("rule is disabled")
+	}
+
+	if strings.HasPrefix(r.Listen, "unix:") {
+		for _, f := range fs.List() {
+			if f.Rule.Listen == r.Listen {
+				return nil, fmt.Errorf("%s is in use by another rule", r.Listen)
+			}
+		}
+	}
+
+	f, err := ForwardRule(fs.tunnel, r)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	fs.list = append(fs.list, f)
+	fs.mu.Unlock()
+	return f, nil
+}
+
+// Remove stops the rules listening on listen, open connections are kept.
+func (fs *Forwards) Remove(listen string) error {
+	fs.mu.Lock()
+	var removed []*Forwarder
+	fs.list = slices.DeleteFunc(fs.list, func(f *Forwarder) bool {
+		if f.Rule.Listen == listen {
+			removed = append(removed, f)
+			return true
+		}
+		return false
+	})
+	fs.mu.Unlock()
+
+	if len(removed) == 0 {
+		return fmt.Errorf("%w: %s", ErrForwardNotFound, listen)
+	}
+	for _, f := range removed {
+		_ = f.Close()
+	}
+	return nil
+}
+
+func (fs *Forwards) List() []*Forwarder {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return slices.Clone(fs.list)
+}
+
+func (fs *Forwards) Close() error {
+	fs.mu.Lock()
+	list := fs.list
+	fs.list = nil
+	fs.mu.Unlock()
+
+	for _, f := range list {
+		_ = f.Close()
+	}
+	return nil
+}
+
+// Forwarder relays the connections of a listener to the target of a rule.
+type Forwarder struct {
+	Rule forward.Rule
+
+	tunnel  Tunnel
+	lis     net.Listener
+	pc      net.PacketConn
+	limiter *rate.Limiter
+	active  atomic.Int64
+	total   atomic.Uint64
+}
+
+// ForwardRule listens on the address of r and serves it until Close.
+func ForwardRule(t Tunnel, r forward.Rule) (*Forwarder, error) {
+	f := &Forwarder{Rule: r, tunnel: t}
+	if r.Bandwidth > 0 {
+		// a burst of a second, but big enough for a whole datagram
+		f.limiter = rate.NewLimiter(rate.Limit(r.Bandwidth), max(int(r.Bandwidth), protomsg.MaxPacketSize))
+	}
+
+	if r.Network == forward.NetworkUDP {
+		pc, err := net.ListenPacket("udp", r.Listen)
+		if err != nil {
+			return nil, err
+		}
+		f.pc = pc
+		slog.Debug("new forward", "listen", pc.LocalAddr(), "target", r.Target())
+		go f.serveUDP()
+		return f, nil
+	}
+
+	lis, err := listen(r.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.TLS != nil {
+		cert, err := tls.LoadX509KeyPair(r.TLS.Cert, r.TLS.Key)
+		if err != nil {
+			lis.Close()
+			return nil, err
+		}
+		lis = tls.NewListener(lis, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+
+	f.lis = lis
+	slog.Debug("new forward", "listen", lis.Addr(), "target", r.Target())
+	go f.serve()
+	return f, nil
+}
+
+// Addr is the address the rule listens on.
+func (f *Forwarder) Addr() net.Addr {
+	if f.pc != nil {
+		return f.pc.LocalAddr()
+	}
+	return f.lis.Addr()
+}
+
+// Connections returns the open connections and all connections so far,
+// a udp session counts as a connection.
+func (f *Forwarder) Connections() (active int64, total uint64) {
+	return f.active.Load(), f.total.Load()
+}
+
+func (f *Forwarder) count() func() {
+	f.active.Add(1)
+	f.total.Add(1)
+	return func() { f.active.Add(-1) }
+}
+
+func (f *Forwarder) Close() error {
+	if f.pc != nil {
+		return f.pc.Close()
+	}
+	return f.lis.Close()
+}
+
+func listen(host string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(host, "unix:")
+	if !ok {
+		return net.Listen("tcp", host)
+	}
+	return ListenUnix(path)
+}
+
+// ListenUnix listens on the unix socket path. A socket left by a previous
+// run would fail the listen and is removed, a socket that still accepts
+// connections is not taken over.
+func ListenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			_ = os.Remove(path)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+func (f *Forwarder) serve() {
+	for {
+		conn, err := f.lis.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("forward accept failed", "listen", f.Rule.Listen, "err", err)
+			}
+			return
+		}
+
+		go f.handle(conn)
+	}
+}
+
+func (f *Forwarder) open(from net.Addr) (net.Conn, error) {
+	ctx := accesslog.WithSource(context.TODO(), accesslog.Source{
+		Frontend: "forward",
+		Addr:     from.String(),
+	})
+
+	if f.Rule.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(f.Rule.DialTimeout))
+		defer cancel()
+	}
+
+	req := f.Rule.Target().NewConnect()
+	req.GetConnect().Ack = true
+	return f.tunnel.OpenStream(ctx, req)
+}
+
+func (f *Forwarder) handle(conn net.Conn) {
+	defer conn.Close()
+	defer f.count()()
+
+	remote, err := f.open(conn.RemoteAddr())
+	if err != nil {
+		slog.Error("open stream failed", "listen", f.Rule.Listen, "target", f.Rule.Target(), "err", err)
+		return
+	}
+	defer remote.Close()
+
+	if f.Rule.ProxyProtocol != "" {
+		if _, err := remote.Write(proxyHeader(f.Rule.ProxyProtocol, conn.RemoteAddr(), conn.LocalAddr())); err != nil {
+			return
+		}
+	}
+
+	local, target, stop := f.limit(conn, remote)
+	defer stop()
+
+	relay.Relay(target, local)
+}
+
+// limit applies the idle timeout and the bandwidth of the rule to both
+// directions of a stream.
+func (f *Forwarder) limit(a, b net.Conn) (net.Conn, net.Conn, func()) {
+	timeout := time.Duration(f.Rule.IdleTimeout)
+	if timeout <= 0 && f.limiter == nil {
+		return a, b, func() {}
+	}
+
+	var idle *time.Timer
+	if timeout > 0 {
+		idle = time.AfterFunc(timeout, func() {
+			a.Close()
+			b.Close()
+		})
+	}
+
+	stop := func() {
+		if idle != nil {
+			idle.Stop()
+		}
+	}
+	return &limitConn{Conn: a, idle: idle, timeout: timeout, limiter: f.limiter},
+		&limitConn{Conn: b, idle: idle, timeout: timeout, limiter: f.limiter}, stop
+}
+
+type limitConn struct {
+	net.Conn
+	idle    *time.Timer
+	timeout time.Duration
+	limiter *rate.Limiter
+}
+
+func (c *limitConn) Read(b []byte) (int, error) {
+	if c.limiter != nil && len(b) > c.limiter.Burst() {
+		b = b[:c.limiter.Burst()]
+	}
+
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if c.idle != nil {
+			c.idle.Reset(c.timeout)
+		}
+		if c.limiter != nil {
+			_ = c.limiter.WaitN(context.Background(), n)
+		}
+	}
+	return n, err
+}
+
+func (c *limitConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+func (f *Forwarder) serveUDP() {
+	var mu sync.Mutex
+	sessions := map[string]chan []byte{}
+
+	buf := make([]byte, protomsg.MaxPacketSize)
+	for {
+		n, addr, err := f.pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("forward read failed", "listen", f.Rule.Listen, "err", err)
+			}
+			return
+		}
+
+		key := addr.String()
+
+		mu.Lock()
+		packets, ok := sessions[key]
+		if !ok {
+			packets = make(chan []byte, 64)
+			sessions[key] = packets
+			go func() {
+				f.udpSession(addr, packets)
+				mu.Lock()
+				delete(sessions, key)
+				mu.Unlock()
+			}()
+		}
+		mu.Unlock()
+
+		select {
+		case packets <- bytes.Clone(buf[:n]):
+		default:
+			// the session is behind, drop like a full socket buffer would
+		}
+	}
+}
+
+// udpSession relays the datagrams of one source through its own stream,
+// until the session idles.
+func (f *Forwarder) udpSession(addr net.Addr, packets <-chan []byte) {
+	defer f.count()()
+
+	remote, err := f.open(addr)
+	if err != nil {
+		slog.Error("open stream failed", "listen", f.Rule.Listen, "target", f.Rule.Target(), "err", err)
+		return
+	}
+	defer remote.Close()
+
+	timeout := time.Duration(f.Rule.IdleTimeout)
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	idle := time.AfterFunc(timeout, func() { remote.Close() })
+	defer idle.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		buf := make([]byte, protomsg.MaxPacketSize)
+		for {
+			n, err := protomsg.ReadPacket(remote, buf)
+			if err != nil {
+				return
+			}
+			idle.Reset(timeout)
+			f.wait(n)
+			if _, err := f.pc.WriteTo(buf[:n], addr); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case b := <-packets:
+			idle.Reset(timeout)
+			f.wait(len(b))
+			if err := protomsg.WritePacket(remote, b); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (f *Forwarder) wait(n int) {
+	if f.limiter != nil {
+		_ = f.limiter.WaitN(context.Background(), min(n, f.limiter.Burst()))
+	}
+}
@@ -0,0 +1,157 @@
+package api_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Asutorufa/tunnel/pkg/api"
+	"github.com/Asutorufa/tunnel/pkg/forward"
+	"github.com/Asutorufa/tunnel/pkg/tunneltest"
+)
+
+func TestForwardRuleUDP(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	h.NewDevice("dev1")
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	for _, tunnel := range []api.Tunnel{h.Server, h.NewClient("requester")} {
+		f, err := api.ForwardRule(tunnel, forward.Rule{
+			Listen:  "127.0.0.1:0",
+			Network: forward.NetworkUDP,
+			UUID:    "dev1",
+			Address: "127.0.0.1",
+			Port:    uint16(pc.LocalAddr().(*net.UDPAddr).Port),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		conn, err := net.Dial("udp", f.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		for _, msg := range []string{"first", "second datagram"} {
+			if _, err := conn.Write([]byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 2048)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf[:n]) != msg {
+				t.Errorf("expect %q, got %q", msg, buf[:n])
+			}
+		}
+	}
+}
+
+func TestForwardRuleProxyProtocol(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	h.NewDevice("dev1")
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	headers := make(chan string, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		headers <- line
+	}()
+
+	f, err := api.ForwardRule(h.Server, forward.Rule{
+		Listen:        "127.0.0.1:0",
+		UUID:          "dev1",
+		Address:       "127.0.0.1",
+		Port:          uint16(lis.Addr().(*net.TCPAddr).Port),
+		ProxyProtocol: "v1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	conn, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	local, remote := conn.LocalAddr().(*net.TCPAddr), conn.RemoteAddr().(*net.TCPAddr)
+	want := strings.Join([]string{"PROXY", "TCP4", local.IP.String(), remote.IP.String(),
+		strconv.Itoa(local.Port), strconv.Itoa(remote.Port)}, " ") + "\r\n"
+
+	select {
+	case got := <-headers:
+		if got != want {
+			t.Errorf("expect %q, got %q", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for proxy header")
+	}
+}
+
+func TestForwardRuleIdleTimeout(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	h.NewDevice("dev1")
+
+	f, err := api.ForwardRule(h.Server, forward.Rule{
+		Listen:      "127.0.0.1:0",
+		UUID:        "dev1",
+		Address:     "127.0.0.1",
+		Port:        tunneltest.EchoServer(t),
+		IdleTimeout: forward.Duration(200 * time.Millisecond),
+		Bandwidth:   1 << 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	conn, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tunneltest.AssertEcho(t, conn)
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expect idle stream closed with eof, got %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+
+	"github.com/Asutorufa/tunnel/pkg/accesslog"
+	"github.com/Asutorufa/tunnel/pkg/auth"
+	"github.com/Asutorufa/yuhaiin/pkg/utils/relay"
+)
+
+// HTTPProxy is an http proxy handler, the hosts of CONNECT and absolute-uri
+// requests are dialed with a Dialer.
+type HTTPProxy struct {
+	dialer *Dialer
+	creds  *auth.Credentials
+	proxy  *httputil.ReverseProxy
+}
+
+// NewHTTPProxy returns a proxy that dials with d, with creds clients must use
+// basic proxy auth and can only open the device ports allowed for their identity.
+func NewHTTPProxy(d *Dialer, creds *auth.Credentials) *HTTPProxy {
+	p := &HTTPProxy{dialer: d.withAuth(creds), creds: creds}
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite: func(*httputil.ProxyRequest) {},
+		Transport: &http.Transport{
+			DialContext: p.dialer.DialContext,
+			// a pooled stream would be logged for the requester that opened it
+			DisableKeepAlives: true,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.Error("http proxy failed", "host", r.Host, "err", err)
+			if errors.Is(err, auth.ErrForbidden) || errors.Is(err, ErrRejected) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	return p
+}
+
+// HTTPServer serves an HTTPProxy on host.
+func HTTPServer(host string, d *Dialer, creds *auth.Credentials) (io.Closer, error) {
+	lis, err := net.Listen("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{
+		Handler:           NewHTTPProxy(d, creds),
+		ReadHeaderTimeout: time.Second * 30,
+	}
+
+	go func() {
+		if err := server.Serve(lis); err != nil && err != http.ErrServerClosed {
+			slog.Error("http proxy server failed", "host", host, "err", err)
+		}
+	}()
+
+	return server, nil
+}
+
+func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	source := accesslog.Source{Frontend: "http", Addr: r.RemoteAddr}
+	ctx := r.Context()
+
+	if p.creds != nil {
+		identity, ok := p.authenticate(r)
+		if !ok {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="tunnel"`)
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+
+		source.Identity = identity.Name
+		ctx = auth.WithIdentity(ctx, identity)
+	}
+
+	ctx = accesslog.WithSource(ctx, source)
+
+	switch {
+	case r.Method == http.MethodConnect:
+		p.connect(ctx, w, r)
+	case r.URL.IsAbs():
+		p.proxy.ServeHTTP(w, r.WithContext(ctx))
+	default:
+		http.Error(w, "not a proxy request", http.StatusBadRequest)
+	}
+}
+
+func (p *HTTPProxy) authenticate(r *http.Request) (*auth.Identity, bool) {
+	username, password, ok := parseProxyAuth(r.Header.Get("Proxy-Authorization"))
+	if !ok {
+		return nil, false
+	}
+
+	return p.creds.Authenticate(username, password)
+}
+
+func parseProxyAuth(auth string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+
+	data, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+
+	return strings.Cut(string(data), ":")
+}
+
+func (p *HTTPProxy) connect(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijack unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	remote, err := p.dialer.DialContext(ctx, "tcp", r.Host)
+	if err != nil {
+		slog.Error("open stream failed", "host", r.Host, "err", err)
+		code := http.StatusBadGateway
+		if errors.Is(err, auth.ErrForbidden) || errors.Is(err, ErrRejected) {
+			code = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	defer remote.Close()
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		slog.Error("hijack failed", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+
+	relay.Relay(remote, &bufferedConn{Conn: conn, r: rw.Reader})
+}
+
+// bufferedConn reads the bytes the http server has already buffered first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
@@ -0,0 +1,126 @@
+package api_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/Asutorufa/tunnel/pkg/api"
+	"github.com/Asutorufa/tunnel/pkg/auth"
+	"github.com/Asutorufa/tunnel/pkg/tunneltest"
+)
+
+func TestHTTPProxyConnect(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	h.NewDevice("dev1")
+	port := tunneltest.EchoServer(t)
+
+	for _, tunnel := range []api.Tunnel{h.Server, h.NewClient("requester")} {
+		host := tunneltest.FreeAddr(t)
+		s, err := api.HTTPServer(host, api.NewDialer(tunnel), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		conn, err := net.Dial("tcp", host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		target := net.JoinHostPort("127.0.0.1.dev1.tunnel", strconv.Itoa(int(port)))
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status: %s", resp.Status)
+		}
+
+		tunneltest.AssertEcho(t, &readerConn{Conn: conn, r: br})
+	}
+}
+
+func TestHTTPProxyRequest(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	h.NewDevice("dev1")
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = http.Serve(lis, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, "hello "+r.URL.Path)
+		}))
+	}()
+	defer lis.Close()
+
+	host := tunneltest.FreeAddr(t)
+	creds, err := auth.New(
+		auth.User{Username: "user", Password: "pass", Allow: []string{"dev1"}},
+		auth.User{Username: "other", Password: "pass", Allow: []string{"dev2"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := api.HTTPServer(host, api.NewDialer(h.Server), creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	target := "http://" + net.JoinHostPort("dev1.tunnel", strconv.Itoa(lis.Addr().(*net.TCPAddr).Port)) + "/path"
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: host})}}
+	resp, err := client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("expect proxy auth required, got %s", resp.Status)
+	}
+
+	client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: host, User: url.UserPassword("other", "pass")})}}
+	resp, err = client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expect forbidden, got %s", resp.Status)
+	}
+
+	client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: host, User: url.UserPassword("user", "pass")})}}
+	resp, err = client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello /path" {
+		t.Fatalf("unexpected body: %q", data)
+	}
+}
+
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(b []byte) (int, error) { return c.r.Read(b) }
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/Asutorufa/tunnel/pkg/protomsg"
+)
+
+var ErrNotTunnelName = errors.New("not a tunnel name")
+
+// DefaultSuffix is the last label of tunnel names.
+const DefaultSuffix = "tunnel"
+
+var DefaultNaming = Naming{Suffix: DefaultSuffix}
+
+// Naming maps hostnames to device targets, names have the form
+//
+//	[_service.][host.]device.suffix
+//
+// A missing host is 127.0.0.1 on the device. The host can be an ipv6 address
+// in brackets, "[fd00::1]", or with dashes for colons and an "ip6" label,
+// "fd00--1.ip6", for names that can't contain brackets like http hosts. A
+// service label replaces the port with the well-known port of the service,
+// "_ssh.dev1.tunnel" is 127.0.0.1:22 on dev1.
+type Naming struct {
+	// Suffix of tunnel names, an empty suffix keeps the legacy
+	// "address.device" names that are split at the last dot
+	Suffix string
+}
+
+// Parse returns the target of hostname, names outside the scheme fail with
+// ErrNotTunnelName.
+func (n Naming) Parse(hostname string, port uint16) (protomsg.Target, error) {
+	hostname = strings.TrimSuffix(hostname, ".")
+
+	if n.Suffix == "" {
+		address, device := SplitHostname(hostname)
+		return protomsg.Target{UUID: device, Address: address, Port: port}, nil
+	}
+
+	suffix := "." + strings.Trim(n.Suffix, ".")
+	if len(hostname) <= len(suffix) || !strings.EqualFold(hostname[len(hostname)-len(suffix):], suffix) {
+		return protomsg.Target{}, fmt.Errorf("%w: %q does not end with %s", ErrNotTunnelName, hostname, suffix)
+	}
+	name := hostname[:len(hostname)-len(suffix)]
+
+	host, device := "", name
+	if i := strings.LastIndexByte(name, '.'); i != -1 {
+		host, device = name[:i], name[i+1:]
+	}
+	if device == "" {
+		return protomsg.Target{}, fmt.Errorf("%w: %q has no device", ErrNotTunnelName, hostname)
+	}
+
+	if strings.HasPrefix(host, "_") {
+		service, rest, _ := strings.Cut(host, ".")
+		p, err := net.LookupPort("tcp", service[1:])
+		if err != nil {
+			return protomsg.Target{}, fmt.Errorf("invalid service in %q: %w", hostname, err)
+		}
+		host, port = rest, uint16(p)
+	}
+
+	address, err := parseHost(host)
+	if err != nil {
+		return protomsg.Target{}, fmt.Errorf("invalid host in %q: %w", hostname, err)
+	}
+
+	return protomsg.Target{UUID: device, Address: address, Port: port}, nil
+}
+
+// Match reports whether hostname ends with the suffix, it is always false
+// for legacy names.
+func (n Naming) Match(hostname string) bool {
+	if n.Suffix == "" {
+		return false
+	}
+
+	_, err := n.Parse(hostname, 0)
+	return !errors.Is(err, ErrNotTunnelName)
+}
+
+func parseHost(host string) (string, error) {
+	switch {
+	case host == "":
+		return "127.0.0.1", nil
+	case strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]"):
+		addr, err := netip.ParseAddr(host[1 : len(host)-1])
+		if err != nil {
+			return "", err
+		}
+		return addr.String(), nil
+	case strings.HasSuffix(host, ".ip6"):
+		addr, err := netip.ParseAddr(strings.ReplaceAll(strings.TrimSuffix(host, ".ip6"), "-", ":"))
+		if err != nil || !addr.Is6() {
+			return "", fmt.Errorf("invalid ipv6 %q", host)
+		}
+		return addr.String(), nil
+	case strings.ContainsAny(host, "[]:"):
+		return "", fmt.Errorf("unexpected %q, ipv6 must be in brackets", host)
+	}
+
+	return host, nil
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Asutorufa/tunnel/pkg/protomsg"
+)
+
+func TestNaming(t *testing.T) {
+	for _, tt := range []struct {
+		hostname string
+		port     uint16
+		want     protomsg.Target
+	}{
+		{"dev1.tunnel", 22, protomsg.Target{UUID: "dev1", Address: "127.0.0.1", Port: 22}},
+		{"dev1.tunnel.", 22, protomsg.Target{UUID: "dev1", Address: "127.0.0.1", Port: 22}},
+		{"DEV1.Tunnel", 22, protomsg.Target{UUID: "DEV1", Address: "127.0.0.1", Port: 22}},
+		{"db.internal.dev1.tunnel", 5432, protomsg.Target{UUID: "dev1", Address: "db.internal", Port: 5432}},
+		{"192.168.1.1.dev1.tunnel", 80, protomsg.Target{UUID: "dev1", Address: "192.168.1.1", Port: 80}},
+		{"[fd00::1].dev1.tunnel", 80, protomsg.Target{UUID: "dev1", Address: "fd00::1", Port: 80}},
+		{"fd00--1.ip6.dev1.tunnel", 80, protomsg.Target{UUID: "dev1", Address: "fd00::1", Port: 80}},
+		{"_ssh.dev1.tunnel", 1, protomsg.Target{UUID: "dev1", Address: "127.0.0.1", Port: 22}},
+		{"_8080.db.dev1.tunnel", 1, protomsg.Target{UUID: "dev1", Address: "db", Port: 8080}},
+	} {
+		got, err := DefaultNaming.Parse(tt.hostname, tt.port)
+		if err != nil {
+			t.Errorf("%s: %v", tt.hostname, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: expect %+v, got %+v", tt.hostname, tt.want, got)
+		}
+	}
+
+	for _, hostname := range []string{"dev1", "example.com", "tunnel", ".tunnel", "dev1.tunnelx"} {
+		if _, err := DefaultNaming.Parse(hostname, 22); !errors.Is(err, ErrNotTunnelName) {
+			t.Errorf("%s: expect not a tunnel name, got %v", hostname, err)
+		}
+	}
+
+	for _, hostname := range []string{"[fd00::zz].dev1.tunnel", "fd00-1.ip6.dev1.tunnel", "fd00::1.dev1.tunnel", "_nosuchservice.dev1.tunnel"} {
+		if _, err := DefaultNaming.Parse(hostname, 22); err == nil || errors.Is(err, ErrNotTunnelName) {
+			t.Errorf("%s: expect invalid name, got %v", hostname, err)
+		}
+	}
+
+	legacy, err := Naming{}.Parse("192.168.1.1.dev1", 80)
+	if err != nil || legacy != (protomsg.Target{UUID: "dev1", Address: "192.168.1.1", Port: 80}) {
+		t.Errorf("legacy: got %+v %v", legacy, err)
+	}
+}
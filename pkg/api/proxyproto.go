@@ -0,0 +1,57 @@
+package api
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeader is the PROXY protocol header of a tcp connection from src to
+// dst, version is v1 or v2. Addresses that are not tcp, like unix sockets,
+// are sent as unknown.
+func proxyHeader(version string, src, dst net.Addr) []byte {
+	s, sok := tcpAddrPort(src)
+	d, dok := tcpAddrPort(dst)
+	ok := sok && dok && s.Addr().Is4() == d.Addr().Is4()
+
+	if version == "v1" {
+		if !ok {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP6"
+		if s.Addr().Is4() {
+			family = "TCP4"
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, s.Addr(), d.Addr(), s.Port(), d.Port())
+	}
+
+	header := append([]byte{}, proxyV2Signature...)
+	if !ok {
+		// LOCAL command, the receiver uses the real connection addresses
+		return append(header, 0x20, 0x00, 0x00, 0x00)
+	}
+
+	family := byte(0x21)
+	if s.Addr().Is4() {
+		family = 0x11
+	}
+	addrs := append(s.Addr().AsSlice(), d.Addr().AsSlice()...)
+	addrs = binary.BigEndian.AppendUint16(addrs, s.Port())
+	addrs = binary.BigEndian.AppendUint16(addrs, d.Port())
+
+	header = append(header, 0x21, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func tcpAddrPort(addr net.Addr) (netip.AddrPort, bool) {
+	a, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	ap := a.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+}
@@ -0,0 +1,259 @@
+package api
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/Asutorufa/tunnel/pkg/accesslog"
+	"github.com/Asutorufa/tunnel/pkg/auth"
+	"github.com/Asutorufa/yuhaiin/pkg/utils/relay"
+)
+
+const socks5HandshakeTimeout = time.Second * 30
+
+const (
+	socks5Version         = 0x05
+	socks5UserPassVersion = 0x01
+
+	socks5NoAuth       = 0x00
+	socks5UserPass     = 0x02
+	socks5NoAcceptable = 0xff
+
+	socks5Connect = 0x01
+
+	socks5IPv4   = 0x01
+	socks5Domain = 0x03
+	socks5IPv6   = 0x04
+
+	socks5Succeeded          = 0x00
+	socks5NotAllowed         = 0x02
+	socks5HostUnreachable    = 0x04
+	socks5CommandUnsupported = 0x07
+	socks5AddressUnsupported = 0x08
+
+	socks5UserPassFailure = 0x01
+)
+
+var errSocks5Auth = errors.New("socks5 authentication failed")
+
+// Socks5Server serves socks5 CONNECT on host, names are dialed with d.
+// With creds clients must authenticate with username and password, and
+// can only open the device ports allowed for their identity.
+func Socks5Server(host string, d *Dialer, creds *auth.Credentials) (io.Closer, error) {
+	lis, err := net.Listen("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &socks5Server{dialer: d.withAuth(creds), creds: creds}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					slog.Error("socks5 accept failed", "host", host, "err", err)
+				}
+				return
+			}
+
+			go s.handle(conn)
+		}
+	}()
+
+	return lis, nil
+}
+
+type socks5Server struct {
+	dialer *Dialer
+	creds  *auth.Credentials
+}
+
+func (s *socks5Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+
+	identity, err := s.handshake(conn)
+	if err != nil {
+		slog.Error("socks5 handshake failed", "remote", conn.RemoteAddr(), "err", err)
+		return
+	}
+
+	hostname, port, err := readSocks5Request(conn)
+	if err != nil {
+		slog.Error("socks5 request failed", "remote", conn.RemoteAddr(), "err", err)
+		return
+	}
+
+	source := accesslog.Source{Frontend: "socks5", Addr: conn.RemoteAddr().String()}
+	ctx := context.TODO()
+	if identity != nil {
+		source.Identity = identity.Name
+		ctx = auth.WithIdentity(ctx, identity)
+	}
+	ctx = accesslog.WithSource(ctx, source)
+
+	remote, err := s.dialer.dial(ctx, hostname, port)
+	if err != nil {
+		slog.Error("open stream failed", "host", hostname, "port", port, "err", err)
+		code := byte(socks5HostUnreachable)
+		if errors.Is(err, auth.ErrForbidden) || errors.Is(err, ErrNotTunnelName) || errors.Is(err, ErrRejected) {
+			code = socks5NotAllowed
+		}
+		_ = writeSocks5Reply(conn, code)
+		return
+	}
+	defer remote.Close()
+
+	if err := writeSocks5Reply(conn, socks5Succeeded); err != nil {
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	relay.Relay(remote, conn)
+}
+
+func (s *socks5Server) handshake(conn net.Conn) (*auth.Identity, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported socks version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+
+	want := byte(socks5NoAuth)
+	if s.creds != nil {
+		want = socks5UserPass
+	}
+
+	found := false
+	for _, m := range methods {
+		if m == want {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		_, _ = conn.Write([]byte{socks5Version, socks5NoAcceptable})
+		return nil, fmt.Errorf("no acceptable auth method in %v", methods)
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, want}); err != nil {
+		return nil, err
+	}
+
+	if s.creds == nil {
+		return nil, nil
+	}
+
+	return s.authenticate(conn)
+}
+
+// authenticate runs the rfc 1929 username/password negotiation.
+func (s *socks5Server) authenticate(conn net.Conn) (*auth.Identity, error) {
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return nil, err
+	}
+	if version[0] != socks5UserPassVersion {
+		return nil, fmt.Errorf("unsupported auth version %d", version[0])
+	}
+
+	username, err := readSocks5String(conn)
+	if err != nil {
+		return nil, err
+	}
+	password, err := readSocks5String(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	identity, ok := s.creds.Authenticate(username, password)
+	if !ok {
+		_, _ = conn.Write([]byte{socks5UserPassVersion, socks5UserPassFailure})
+		return nil, fmt.Errorf("%w: user %q", errSocks5Auth, username)
+	}
+
+	if _, err := conn.Write([]byte{socks5UserPassVersion, socks5Succeeded}); err != nil {
+		return nil, err
+	}
+
+	return identity, nil
+}
+
+func readSocks5String(r io.Reader) (string, error) {
+	size := make([]byte, 1)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return "", err
+	}
+
+	data := make([]byte, size[0])
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func readSocks5Request(conn net.Conn) (string, uint16, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", 0, err
+	}
+	if header[0] != socks5Version {
+		return "", 0, fmt.Errorf("unsupported socks version %d", header[0])
+	}
+
+	if header[1] != socks5Connect {
+		_ = writeSocks5Reply(conn, socks5CommandUnsupported)
+		return "", 0, fmt.Errorf("unsupported socks5 command %d", header[1])
+	}
+
+	var hostname string
+	switch header[3] {
+	case socks5IPv4, socks5IPv6:
+		ip := make([]byte, net.IPv4len)
+		if header[3] == socks5IPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", 0, err
+		}
+		addr, _ := netip.AddrFromSlice(ip)
+		hostname = addr.String()
+	case socks5Domain:
+		domain, err := readSocks5String(conn)
+		if err != nil {
+			return "", 0, err
+		}
+		hostname = domain
+	default:
+		_ = writeSocks5Reply(conn, socks5AddressUnsupported)
+		return "", 0, fmt.Errorf("unsupported socks5 address type %d", header[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", 0, err
+	}
+
+	return hostname, binary.BigEndian.Uint16(port), nil
+}
+
+func writeSocks5Reply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socks5Version, code, 0x00, socks5IPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,236 @@
+// Package auth maps proxy users to requester identities and the device
+// ports they may open.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var ErrForbidden = errors.New("forbidden")
+
+// Credentials is loaded from a json file:
+//
+//	{
+//	  "users": [
+//	    {"username": "alice", "password": "secret", "allow": ["*"]},
+//	    {"username": "ci", "password": "sha256:<hex>", "identity": "build", "allow": ["dev1:22", "dev2:8000-8100,9090"]}
+//	  ]
+//	}
+type Credentials struct {
+	users map[string]*user
+}
+
+type User struct {
+	Username string `json:"username"`
+	// Password is plain text or "sha256:" followed by the hex digest
+	Password string `json:"password"`
+	// Identity defaults to the username
+	Identity string `json:"identity,omitempty"`
+	// Allow lists "device[:ports]", device can be "*" and ports is a comma
+	// separated list of ports and ranges, all ports are allowed without it
+	Allow []string `json:"allow"`
+}
+
+type user struct {
+	password []byte
+	hashed   bool
+	identity *Identity
+}
+
+func Load(path string) (*Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+func Parse(data []byte) (*Credentials, error) {
+	var file struct {
+		Users []User `json:"users"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	return New(file.Users...)
+}
+
+func New(users ...User) (*Credentials, error) {
+	c := &Credentials{users: make(map[string]*user, len(users))}
+
+	for _, u := range users {
+		if u.Username == "" {
+			return nil, errors.New("user without username")
+		}
+		if _, ok := c.users[u.Username]; ok {
+			return nil, fmt.Errorf("duplicate user %s", u.Username)
+		}
+
+		identity := &Identity{Name: u.Identity}
+		if identity.Name == "" {
+			identity.Name = u.Username
+		}
+
+		for _, a := range u.Allow {
+			p, err := ParsePermission(a)
+			if err != nil {
+				return nil, fmt.Errorf("user %s: %w", u.Username, err)
+			}
+			identity.Allow = append(identity.Allow, p)
+		}
+
+		entry := &user{password: []byte(u.Password), identity: identity}
+		if digest, ok := strings.CutPrefix(u.Password, "sha256:"); ok {
+			sum, err := hex.DecodeString(digest)
+			if err != nil || len(sum) != sha256.Size {
+				return nil, fmt.Errorf("user %s: invalid sha256 password", u.Username)
+			}
+			entry.password, entry.hashed = sum, true
+		}
+
+		c.users[u.Username] = entry
+	}
+
+	return c, nil
+}
+
+// Authenticate returns the identity of username when password matches.
+func (c *Credentials) Authenticate(username, password string) (*Identity, bool) {
+	u, ok := c.users[username]
+	if !ok {
+		return nil, false
+	}
+
+	given := []byte(password)
+	if u.hashed {
+		sum := sha256.Sum256(given)
+		given = sum[:]
+	}
+
+	if subtle.ConstantTimeCompare(given, u.password) != 1 {
+		return nil, false
+	}
+
+	return u.identity, true
+}
+
+// Identity is an authenticated requester.
+type Identity struct {
+	Name  string
+	Allow []Permission
+}
+
+func (i *Identity) Allowed(device string, port uint16) bool {
+	if i == nil {
+		return false
+	}
+
+	for _, p := range i.Allow {
+		if p.Match(device, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns ErrForbidden when the identity may not open port on device.
+func (i *Identity) Check(device string, port uint16) error {
+	if i.Allowed(device, port) {
+		return nil
+	}
+
+	name := "anonymous"
+	if i != nil {
+		name = i.Name
+	}
+	return fmt.Errorf("%w: %s to %s:%d", ErrForbidden, name, device, port)
+}
+
+type Permission struct {
+	// Device is a device uuid or "*"
+	Device string
+	// Ports allowed on the device, empty allows all ports
+	Ports []PortRange
+}
+
+type PortRange struct {
+	From, To uint16
+}
+
+func ParsePermission(s string) (Permission, error) {
+	device, ports, ok := strings.Cut(s, ":")
+	if device == "" {
+		return Permission{}, fmt.Errorf("invalid permission %q: empty device", s)
+	}
+
+	p := Permission{Device: device}
+	if !ok || ports == "*" {
+		return p, nil
+	}
+
+	for _, r := range strings.Split(ports, ",") {
+		from, to, isRange := strings.Cut(r, "-")
+		if !isRange {
+			to = from
+		}
+
+		f, err := strconv.ParseUint(from, 10, 16)
+		if err != nil {
+			return Permission{}, fmt.Errorf("invalid permission %q: %w", s, err)
+		}
+		t, err := strconv.ParseUint(to, 10, 16)
+		if err != nil {
+			return Permission{}, fmt.Errorf("invalid permission %q: %w", s, err)
+		}
+		if f > t {
+			return Permission{}, fmt.Errorf("invalid permission %q: port range %s", s, r)
+		}
+
+		p.Ports = append(p.Ports, PortRange{From: uint16(f), To: uint16(t)})
+	}
+
+	return p, nil
+}
+
+func (p Permission) Match(device string, port uint16) bool {
+	if p.Device != "*" && p.Device != device {
+		return false
+	}
+
+	if len(p.Ports) == 0 {
+		return true
+	}
+
+	for _, r := range p.Ports {
+		if port >= r.From && port <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+type identityKey struct{}
+
+func WithIdentity(ctx context.Context, i *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, i)
+}
+
+func IdentityFrom(ctx context.Context) *Identity {
+	i, _ := ctx.Value(identityKey{}).(*Identity)
+	return i
+}
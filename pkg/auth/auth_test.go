@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestCredentials(t *testing.T) {
+	sum := sha256.Sum256([]byte("s3cret"))
+
+	c, err := Parse([]byte(`{"users": [
+		{"username": "alice", "password": "secret", "allow": ["*"]},
+		{"username": "ci", "password": "sha256:` + hex.EncodeToString(sum[:]) + `", "identity": "build", "allow": ["dev1:22", "dev2:8000-8100,9090"]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := c.Authenticate("alice", "wrong"); ok {
+		t.Fatal("wrong password should fail")
+	}
+	if _, ok := c.Authenticate("bob", "secret"); ok {
+		t.Fatal("unknown user should fail")
+	}
+
+	alice, ok := c.Authenticate("alice", "secret")
+	if !ok || alice.Name != "alice" || !alice.Allowed("dev3", 1) {
+		t.Fatalf("unexpected identity: %+v", alice)
+	}
+
+	ci, ok := c.Authenticate("ci", "s3cret")
+	if !ok || ci.Name != "build" {
+		t.Fatalf("unexpected identity: %+v", ci)
+	}
+
+	for _, tc := range []struct {
+		device string
+		port   uint16
+		allow  bool
+	}{
+		{"dev1", 22, true},
+		{"dev1", 23, false},
+		{"dev2", 8000, true},
+		{"dev2", 8100, true},
+		{"dev2", 8101, false},
+		{"dev2", 9090, true},
+		{"dev3", 22, false},
+	} {
+		if got := ci.Allowed(tc.device, tc.port); got != tc.allow {
+			t.Errorf("%s:%d expect %v, got %v", tc.device, tc.port, tc.allow, got)
+		}
+	}
+
+	if err := ci.Check("dev3", 22); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expect forbidden, got %v", err)
+	}
+	var anonymous *Identity
+	if err := anonymous.Check("dev1", 22); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expect forbidden, got %v", err)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, data := range []string{
+		`{"users": [{"password": "a"}]}`,
+		`{"users": [{"username": "a"}, {"username": "a"}]}`,
+		`{"users": [{"username": "a", "password": "sha256:zz"}]}`,
+		`{"users": [{"username": "a", "allow": [":22"]}]}`,
+		`{"users": [{"username": "a", "allow": ["dev1:70000"]}]}`,
+		`{"users": [{"username": "a", "allow": ["dev1:30-20"]}]}`,
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("expect error for %s", data)
+		}
+	}
+}
@@ -1,27 +1,66 @@
 package tunnelclient
 
 import (
+	"cmp"
 	"context"
+	"crypto/tls"
 	"fmt"
-	"io"
 	"log/slog"
 	"net"
+	"net/netip"
+	"sync"
 	"time"
 
+	"github.com/Asutorufa/tunnel/pkg/accesslog"
 	"github.com/Asutorufa/tunnel/pkg/protomsg"
+	"github.com/Asutorufa/tunnel/pkg/route"
 	"github.com/Asutorufa/yuhaiin/pkg/net/netapi"
 	"github.com/Asutorufa/yuhaiin/pkg/utils/relay"
 )
 
 type Client struct {
-	UUID     string
-	Server   string
+	UUID   string
+	Server string
+	// S5Dialer reaches the server through a proxy, any netapi.Proxy works,
+	// upstream.Chain builds one from several hops
 	S5Dialer netapi.Proxy
-	PongChan chan struct{}
+	// TLS to the server, nil connects in plain tcp
+	TLS *tls.Config
+	// Keepalive of the control connection, the server is asked to use it too
+	Keepalive protomsg.KeepaliveConfig
+	// AccessLog records the streams this device opens for requesters
+	AccessLog accesslog.Logger
+	// Routes are advertised to the server, requesters connecting to an ip in
+	// them are sent to this device
+	Routes []netip.Prefix
+	// Sockets are the unix sockets requesters can open by name, like
+	// "docker": "/var/run/docker.sock"
+	Sockets map[string]string
+	// Egress decides how targets of requesters are dialed, directly, through
+	// one of EgressProxies or not at all. Nil dials everything directly.
+	Egress *route.Table
+	// EgressProxies are the proxies of egress proxy rules by via, rules
+	// without via use DefaultEgressProxy
+	EgressProxies map[string]netapi.Proxy
+	// ExitNode offers this device to requesters as an exit for their general
+	// traffic, ExitPolicy rejects destinations of that traffic. Without a
+	// policy only public addresses can be reached.
+	ExitNode   bool
+	ExitPolicy *route.Table
+
+	mu         sync.Mutex
+	conn       net.Conn
+	session    *session
+	registered time.Time
+	// serverHello is the hello of the server of the last registration
+	serverHello *protomsg.Hello
+	closed      bool
+	listeners   map[uint16]*listener
+	streams     streams
 }
 
 func (c *Client) OpenStream(ctx context.Context, t *protomsg.Request) (net.Conn, error) {
-	remote, err := c.connectServer()
+	remote, err := c.connectServer(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -32,57 +71,120 @@ func (c *Client) OpenStream(ctx context.Context, t *protomsg.Request) (net.Conn,
 		return nil, err
 	}
 
-	return remote, nil
+	if t.GetConnect().GetAck() {
+		hello, err := protomsg.ReadOk(remote)
+		if err != nil {
+			remote.Close()
+			return nil, err
+		}
+
+		// an old server relays what it doesn't understand as tcp
+		if missing := t.GetConnect().Needs() &^ hello.FeatureSet(); missing != 0 {
+			remote.Close()
+			return nil, fmt.Errorf("%w: server (%s) does not support %s, upgrade the server",
+				protomsg.ErrUnsupported, cmp.Or(hello.GetVersion(), "unknown version"), missing)
+		}
+	}
+
+	return c.streams.track(remote, StreamOut, t.GetConnect().GetTarget(), t.GetConnect().HostPort()), nil
 }
 
 func (c *Client) Register() error {
 	slog.Debug("try register to", "server", c.Server)
 
-	conn, err := c.connectServer()
+	conn, err := c.connectServer(context.Background())
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
 
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	c.conn = conn
+	c.mu.Unlock()
+
+	device := &protomsg.Device{Uuid: c.UUID, Hello: protomsg.NewHello()}
+	if c.Keepalive.Interval > 0 {
+		device.KeepaliveInterval = uint32(c.Keepalive.Interval.Milliseconds())
+	}
+	if c.Keepalive.Timeout > 0 {
+		device.KeepaliveTimeout = uint32(c.Keepalive.Timeout.Milliseconds())
+	}
+	device.ExitNode = c.ExitNode
+	for _, r := range c.Routes {
+		device.Routes = append(device.Routes, r.String())
+	}
+
+	protomsg.SetKeepaliveSockopt(conn, c.Keepalive)
+
 	_ = conn.SetWriteDeadline(time.Now().Add(time.Minute))
-	if err := protomsg.SendRegister(conn, c.UUID); err != nil {
+	hello, err := protomsg.Register(conn, device)
+	if err != nil {
 		return err
 	}
 	_ = conn.SetWriteDeadline(time.Time{})
 
-	slog.Debug("register success", "server", c.Server)
+	if err := protomsg.CheckHello("client", "server "+c.Server, hello); err != nil {
+		return err
+	}
 
-	go func() {
-		ticker := time.NewTicker(time.Second * 15)
-		defer ticker.Stop()
-
-		for range ticker.C {
-			if err := protomsg.SendPing(conn); err != nil {
-				slog.Error("send ping failed", "err", err)
-				conn.Close()
-				return
-			}
+	slog.Debug("register success", "server", c.Server, "version", hello.GetVersion(), "protocol", hello.GetProtocol())
 
-			select {
-			case <-c.PongChan:
-			case <-time.After(time.Second * 10):
-				slog.Error("ping timeout")
-				conn.Close()
-				return
-			}
+	s := newSession(conn, c.Keepalive)
+	defer s.Close()
+
+	c.mu.Lock()
+	c.session = s
+	c.registered = time.Now()
+	c.serverHello = hello
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		if c.session == s {
+			c.session = nil
+		}
+		c.mu.Unlock()
+	}()
+
+	go func() {
+		if err := s.keepalive.Run(s.writer, s.closed); err != nil {
+			slog.Error("keepalive failed", "err", err)
+			s.Close()
 		}
 	}()
 
 	for {
-		if err := c.handle(conn); err != nil {
+		if err := c.handle(s); err != nil {
+			if s.reconnect.Load() {
+				return ErrReconnect
+			}
 			return err
 		}
 	}
 }
 
-func (c *Client) connectServer() (net.Conn, error) {
+func (c *Client) connectServer(ctx context.Context) (net.Conn, error) {
+	conn, err := c.dialServer(ctx)
+	if err != nil || c.TLS == nil {
+		return conn, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+	tc := tls.Client(conn, c.TLS)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+func (c *Client) dialServer(ctx context.Context) (net.Conn, error) {
 	if c.S5Dialer != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		ctx, cancel := context.WithTimeout(ctx, time.Second*5)
 		defer cancel()
 		saddr, err := netapi.ParseAddress("tcp", c.Server)
 		if err != nil {
@@ -91,17 +193,25 @@ func (c *Client) connectServer() (net.Conn, error) {
 		return c.S5Dialer.Conn(ctx, saddr)
 	}
 
-	return net.DialTimeout("tcp", c.Server, time.Second*10)
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", c.Server)
 }
 
-func (c *Client) handle(lis io.ReadWriter) error {
-	req, err := protomsg.GetRequestReader(lis)
+func (c *Client) handle(s *session) error {
+	req, err := protomsg.GetRequestReader(s.conn)
 	if err != nil {
 		return err
 	}
 
 	switch req.GetType() {
 	case protomsg.Type_Connection:
+		if req.GetConnect() == nil {
+			slog.Error("connection without payload")
+			return nil
+		}
+
 		go func() {
 			if err := c.handleConnect(req); err != nil {
 				slog.Error("handle connect failed", "err", err)
@@ -109,9 +219,11 @@ func (c *Client) handle(lis io.ReadWriter) error {
 		}()
 
 	case protomsg.Type_Pong:
-		c.PongChan <- struct{}{}
+		s.keepalive.HandlePong(req.GetPong())
 	case protomsg.Type_Ping:
-		protomsg.SendPong(lis)
+		if err := s.writer.SendPriority(context.TODO(), protomsg.NewPongFor(req.GetPing())); err != nil {
+			return err
+		}
 	default:
 		slog.Error("unknown request type", "type", req.GetType())
 	}
@@ -120,43 +232,105 @@ func (c *Client) handle(lis io.ReadWriter) error {
 }
 
 func (c *Client) handleConnect(req *protomsg.Request) error {
-	port := req.GetConnect().Port
-	address := req.GetConnect().GetAddress()
-	if address == "" {
+	connect := req.GetConnect()
+	port := connect.GetPort()
+	address := connect.GetAddress()
+	unix := connect.GetNetwork() == protomsg.NetworkUnix
+	if address == "" && !unix {
 		address = "127.0.0.1"
 	}
 
-	slog.Debug("connect", "address", address, "port", port)
+	slog.Debug("connect", "network", connect.GetNetwork(), "address", address, "port", port)
+
+	target := net.JoinHostPort(address, fmt.Sprint(port))
+	if connect.GetNetwork() != "" {
+		target = connect.HostPort()
+	}
+	ctx := accesslog.WithSource(context.Background(), accesslog.Source{
+		Frontend: "device",
+		Addr:     c.Server,
+	})
+	entry := accesslog.Begin(ctx, c.AccessLog, c.UUID, target)
+
+	var lis *listener
+	var conn net.Conn
+	var dialErr error
+	network := connect.GetNetwork()
+	switch {
+	case unix:
+		conn, dialErr = c.dialUnix(ctx, address)
+	case network != "" && network != "tcp" && network != protomsg.NetworkUDP:
+		dialErr = fmt.Errorf("unsupported network: %s", network)
+	case connect.GetExit():
+		address, dialErr = c.exitAddress(ctx, address, uint16(port))
+	case network == "" || network == "tcp":
+		lis = c.lookupListener(address, uint16(port))
+	}
+	if conn == nil && lis == nil && dialErr == nil {
+		conn, dialErr = c.dial(ctx, network, address, uint16(port))
+	}
+	if conn != nil {
+		conn = c.streams.track(entry.WrapTarget(conn), StreamIn, c.UUID, target)
+		defer conn.Close()
+	}
 
-	remote, err := c.connectServer()
+	remote, err := c.connectServer(context.Background())
 	if err != nil {
+		entry.Fail(err)
 		return err
 	}
-	defer remote.Close()
+
+	resp := &protomsg.ConnectResponse{
+		Uuid:   c.UUID,
+		Connid: connect.GetId(),
+	}
+	if dialErr != nil {
+		resp.Error = dialErr.Error()
+	}
 
 	err = protomsg.SendRequest(remote, &protomsg.Request{
-		Type: protomsg.Type_Response,
-		Payload: &protomsg.Request_ConnectResponse{
-			ConnectResponse: &protomsg.ConnectResponse{
-				Uuid:   c.UUID,
-				Connid: req.GetConnect().Id,
-			},
-		},
+		Type:    protomsg.Type_Response,
+		Payload: &protomsg.Request_ConnectResponse{ConnectResponse: resp},
 	})
 	if err != nil {
+		entry.Fail(err)
+		remote.Close()
 		return err
 	}
 
-	conn, err := net.DialTimeout("tcp", net.JoinHostPort(address, fmt.Sprint(port)), time.Second*5)
-	if err != nil {
-		return err
+	if dialErr != nil {
+		entry.Fail(dialErr)
+		remote.Close()
+		return dialErr
+	}
+
+	if lis != nil {
+		return lis.deliver(entry.WrapRequester(remote))
 	}
-	defer conn.Close()
 
+	defer remote.Close()
 	relay.Relay(conn, remote)
 	return nil
 }
 
+// Stats returns keepalive statistics of the current registration.
+func (c *Client) Stats() (protomsg.KeepaliveStats, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.session == nil {
+		return protomsg.KeepaliveStats{}, false
+	}
+	return c.session.keepalive.Stats(), true
+}
+
 func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	if c.conn != nil {
+		return c.conn.Close()
+	}
 	return nil
 }
@@ -1,7 +1,11 @@
 package tunnelclient
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"net"
+	"strings"
 	"testing"
 
 	"github.com/Asutorufa/tunnel/pkg/protomsg"
@@ -24,3 +28,42 @@ func TestRule(t *testing.T) {
 
 	t.Log(string(data))
 }
+
+func TestOpenStreamOldServer(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	// a server from before versioning answers without a hello
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			if _, err := protomsg.GetRequestReader(conn); err == nil {
+				_ = protomsg.SendRequest(conn, &protomsg.Request{Type: protomsg.Type_Ok})
+			}
+		}
+	}()
+
+	c := &Client{Server: lis.Addr().String()}
+
+	req := protomsg.Target{UUID: "dev1", Address: "127.0.0.1", Port: 53, Network: protomsg.NetworkUDP}.NewConnect()
+	req.GetConnect().Ack = true
+	if _, err := c.OpenStream(context.Background(), req); !errors.Is(err, protomsg.ErrUnsupported) || !strings.Contains(err.Error(), "upgrade the server") {
+		t.Errorf("expect udp refused by an old server, got %v", err)
+	}
+
+	req = protomsg.NewConnect("dev1", "127.0.0.1", 22)
+	req.GetConnect().Ack = true
+	conn, err := c.OpenStream(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,45 @@
+package tunnelclient
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+type closeCounter struct {
+	net.Conn
+	closed *atomic.Int64
+}
+
+func (c closeCounter) Close() error {
+	c.closed.Add(1)
+	return nil
+}
+
+func TestDeliverClose(t *testing.T) {
+	for range 100 {
+		c := &Client{UUID: "dev1"}
+		lis, err := c.Listen(8000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := lis.(*listener)
+
+		var closed atomic.Int64
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_ = l.deliver(closeCounter{closed: &closed})
+			}()
+		}
+		_ = l.Close()
+		wg.Wait()
+
+		if n := closed.Load(); n != 8 {
+			t.Fatalf("expect all 8 streams closed, got %d", n)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package tunnelclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/Asutorufa/tunnel/pkg/protomsg"
+	"github.com/Asutorufa/tunnel/pkg/route"
+	"github.com/Asutorufa/yuhaiin/pkg/net/netapi"
+)
+
+const DefaultEgressProxy = "default"
+
+var ErrEgressRejected = errors.New("rejected by egress rules")
+
+// dial reaches a target of a requester as the egress rules say, tunnel
+// rules dial directly like direct ones. Udp targets are returned as a
+// protomsg.PacketStream.
+func (c *Client) dial(ctx context.Context, network, host string, port uint16) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+
+	address := net.JoinHostPort(host, strconv.Itoa(int(port)))
+
+	action, via := route.Direct, ""
+	if c.Egress != nil {
+		action, via = c.Egress.Lookup(host, port)
+	}
+
+	switch action {
+	case route.Reject:
+		return nil, fmt.Errorf("%w: %s", ErrEgressRejected, address)
+	case route.Proxy:
+		if network == protomsg.NetworkUDP {
+			return nil, fmt.Errorf("udp through an egress proxy is not supported: %s", address)
+		}
+		if via == "" {
+			via = DefaultEgressProxy
+		}
+		p, ok := c.EgressProxies[via]
+		if !ok {
+			return nil, fmt.Errorf("no egress proxy %q for %s", via, address)
+		}
+		addr, err := netapi.ParseAddress("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		return p.Conn(ctx, addr)
+	}
+
+	var d net.Dialer
+	if network == protomsg.NetworkUDP {
+		conn, err := d.DialContext(ctx, "udp", address)
+		if err != nil {
+			return nil, err
+		}
+		return protomsg.PacketStream(conn), nil
+	}
+	return d.DialContext(ctx, "tcp", address)
+}
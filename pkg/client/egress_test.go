@@ -0,0 +1,75 @@
+package tunnelclient_test
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	tunnelclient "github.com/Asutorufa/tunnel/pkg/client"
+	"github.com/Asutorufa/tunnel/pkg/protomsg"
+	"github.com/Asutorufa/tunnel/pkg/route"
+	"github.com/Asutorufa/tunnel/pkg/tunneltest"
+	"github.com/Asutorufa/tunnel/pkg/upstream"
+	"github.com/Asutorufa/yuhaiin/pkg/net/netapi"
+)
+
+type countProxy struct {
+	netapi.Proxy
+	n atomic.Int32
+}
+
+func (c *countProxy) Conn(ctx context.Context, addr netapi.Address) (net.Conn, error) {
+	c.n.Add(1)
+	return c.Proxy.Conn(ctx, addr)
+}
+
+func TestEgress(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	proxied := tunneltest.EchoServer(t)
+	direct := tunneltest.EchoServer(t)
+
+	egress := &route.Table{Rules: []route.Rule{
+		{CIDR: "127.0.0.1", Port: strconv.Itoa(int(proxied)), Action: route.Proxy, Via: "jump"},
+		{Port: "9", Action: route.Reject},
+		{Port: "10", Action: route.Proxy, Via: "missing"},
+	}}
+	if err := egress.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	jump := &countProxy{Proxy: upstream.Direct}
+	h.NewDevice("dev1", func(c *tunnelclient.Client) {
+		c.Egress = egress
+		c.EgressProxies = map[string]netapi.Proxy{"jump": jump}
+	})
+
+	open := func(port uint16) (net.Conn, error) {
+		return h.Server.OpenStream(context.Background(), protomsg.NewConnect("dev1", "127.0.0.1", port))
+	}
+
+	conn, err := open(proxied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunneltest.AssertEcho(t, conn)
+	conn.Close()
+
+	conn, err = open(direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunneltest.AssertEcho(t, conn)
+	conn.Close()
+
+	if n := jump.n.Load(); n != 1 {
+		t.Errorf("expect one stream through the egress proxy, got %d", n)
+	}
+
+	for _, port := range []uint16{9, 10} {
+		if _, err := open(port); err == nil {
+			t.Errorf("port %d should fail", port)
+		}
+	}
+}
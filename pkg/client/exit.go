@@ -0,0 +1,50 @@
+package tunnelclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/Asutorufa/tunnel/pkg/route"
+)
+
+var (
+	ErrNotExitNode = errors.New("device is not an exit node")
+	ErrExitDenied  = errors.New("denied by exit policy")
+)
+
+// exitAddress resolves the destination of exit traffic and returns the first
+// address the exit policy allows, the name and the address that is dialed
+// must both pass the policy.
+func (c *Client) exitAddress(ctx context.Context, address string, port uint16) (string, error) {
+	if !c.ExitNode {
+		return "", ErrNotExitNode
+	}
+
+	if c.ExitPolicy != nil && c.ExitPolicy.Match(address, port) == route.Reject {
+		return "", fmt.Errorf("%w: %s", ErrExitDenied, address)
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", address)
+	if err != nil {
+		return "", err
+	}
+
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if c.exitAllowed(addr, port) {
+			return addr.String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrExitDenied, address)
+}
+
+func (c *Client) exitAllowed(addr netip.Addr, port uint16) bool {
+	if c.ExitPolicy != nil {
+		return c.ExitPolicy.Match(addr.String(), port) != route.Reject
+	}
+	return addr.IsGlobalUnicast() && !addr.IsPrivate()
+}
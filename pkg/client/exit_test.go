@@ -0,0 +1,62 @@
+package tunnelclient_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	tunnelclient "github.com/Asutorufa/tunnel/pkg/client"
+	"github.com/Asutorufa/tunnel/pkg/protomsg"
+	"github.com/Asutorufa/tunnel/pkg/route"
+	"github.com/Asutorufa/tunnel/pkg/tunneltest"
+)
+
+func TestExitNode(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	port := tunneltest.EchoServer(t)
+
+	policy, err := route.Parse([]byte(`{
+		"rules": [
+			{"suffix": "localhost", "action": "direct"},
+			{"cidr": "127.0.0.1/32", "action": "direct"}
+		],
+		"default": "reject"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.NewDevice("exit1", func(c *tunnelclient.Client) {
+		c.ExitNode = true
+		c.ExitPolicy = policy
+	})
+	h.NewDevice("exit2", func(c *tunnelclient.Client) { c.ExitNode = true })
+	h.NewDevice("dev1")
+
+	open := func(device, address string, port uint16) (net.Conn, error) {
+		req := protomsg.NewConnect(device, address, port)
+		req.GetConnect().Exit = true
+		return h.Server.OpenStream(context.Background(), req)
+	}
+
+	// names are resolved on the exit node, the name and the address must pass
+	conn, err := open("exit1", "localhost", port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunneltest.AssertEcho(t, conn)
+	conn.Close()
+
+	if _, err := open("exit1", "127.0.0.2", port); err == nil {
+		t.Error("exit policy should reject 127.0.0.2")
+	}
+
+	// without a policy only public addresses are allowed
+	if _, err := open("exit2", "127.0.0.1", port); err == nil {
+		t.Error("exit node without policy should reject loopback")
+	}
+
+	if _, err := open("dev1", "127.0.0.1", port); err == nil {
+		t.Error("device that is not an exit node should reject exit traffic")
+	}
+}
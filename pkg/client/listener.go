@@ -0,0 +1,121 @@
+package tunnelclient
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+)
+
+// Listen returns a listener that receives the streams requested for port on
+// this device's loopback address, instead of dialing a local tcp port.
+func (c *Client) Listen(port uint16) (net.Listener, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.listeners[port]; ok {
+		return nil, fmt.Errorf("port %d is already in use", port)
+	}
+
+	if c.listeners == nil {
+		c.listeners = make(map[uint16]*listener)
+	}
+
+	l := &listener{
+		client: c,
+		addr:   Addr{UUID: c.UUID, Port: port},
+		conns:  make(chan net.Conn, 32),
+		closed: make(chan struct{}),
+	}
+	c.listeners[port] = l
+
+	return l, nil
+}
+
+func (c *Client) lookupListener(address string, port uint16) *listener {
+	if address != "localhost" {
+		addr, err := netip.ParseAddr(address)
+		if err != nil || !addr.IsLoopback() {
+			return nil
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.listeners[port]
+}
+
+type Addr struct {
+	UUID string
+	Port uint16
+}
+
+func (a Addr) Network() string { return "tunnel" }
+func (a Addr) String() string  { return net.JoinHostPort(a.UUID, strconv.Itoa(int(a.Port))) }
+
+type listener struct {
+	client *Client
+	addr   Addr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+	// mu orders deliver with the drain of Close, a stream queued after
+	// the drain would never be closed
+	mu sync.Mutex
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) deliver(conn net.Conn) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	select {
+	case <-l.closed:
+		conn.Close()
+		return net.ErrClosed
+	default:
+	}
+
+	select {
+	case l.conns <- conn:
+		return nil
+	case <-l.closed:
+		conn.Close()
+		return net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		l.client.mu.Lock()
+		if l.client.listeners[l.addr.Port] == l {
+			delete(l.client.listeners, l.addr.Port)
+		}
+		l.client.mu.Unlock()
+
+		close(l.closed)
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for {
+			select {
+			case conn := <-l.conns:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func (l *listener) Addr() net.Addr { return l.addr }
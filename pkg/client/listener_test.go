@@ -0,0 +1,56 @@
+package tunnelclient_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/Asutorufa/tunnel/pkg/protomsg"
+	"github.com/Asutorufa/tunnel/pkg/tunneltest"
+)
+
+func TestListen(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	device := h.NewDevice("dev1")
+
+	lis, err := device.Listen(8000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := device.Listen(8000); err == nil {
+		t.Fatal("expect error for duplicate listen")
+	}
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	conn, err := h.Server.OpenStream(context.Background(), protomsg.NewConnect("dev1", "", 8000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tunneltest.AssertEcho(t, conn)
+
+	lis.Close()
+	if _, err := lis.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expect net.ErrClosed, got %v", err)
+	}
+
+	if _, err := h.Server.OpenStream(context.Background(), protomsg.NewConnect("dev1", "", 8000)); err == nil {
+		t.Fatal("expect error after listener closed")
+	}
+}
@@ -0,0 +1,37 @@
+package tunnelclient
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Asutorufa/tunnel/pkg/protomsg"
+)
+
+// session is one registration to the server, pongs never leak into the
+// keepalive of a later registration.
+type session struct {
+	conn      net.Conn
+	writer    *protomsg.Writer
+	keepalive *protomsg.Keepalive
+	closed    chan struct{}
+	once      sync.Once
+	// reconnect is set when Reconnect dropped the session
+	reconnect atomic.Bool
+}
+
+func newSession(conn net.Conn, keepalive protomsg.KeepaliveConfig) *session {
+	return &session{
+		conn:      conn,
+		writer:    protomsg.NewWriter(conn, 16, time.Second*10),
+		keepalive: protomsg.NewKeepalive(keepalive),
+		closed:    make(chan struct{}),
+	}
+}
+
+func (s *session) Close() error {
+	s.once.Do(func() { close(s.closed) })
+	_ = s.writer.Close()
+	return s.conn.Close()
+}
@@ -0,0 +1,151 @@
+package tunnelclient
+
+import (
+	"cmp"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Asutorufa/tunnel/pkg/protomsg"
+)
+
+type Status struct {
+	UUID       string `json:"uuid"`
+	Server     string `json:"server"`
+	Registered bool   `json:"registered"`
+	// Since is when the current registration started
+	Since     time.Time               `json:"since"`
+	Keepalive protomsg.KeepaliveStats `json:"keepalive"`
+	Streams   int                     `json:"streams"`
+	// Protocol, ServerVersion and Features are of the server of the last
+	// registration, Features are the ones both sides support
+	Protocol      uint32 `json:"protocol"`
+	ServerVersion string `json:"server_version,omitempty"`
+	Features      string `json:"features,omitempty"`
+}
+
+// Status of the registration to the server.
+func (c *Client) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st := Status{
+		UUID:       c.UUID,
+		Server:     c.Server,
+		Registered: c.session != nil,
+		Streams:    c.streams.len(),
+	}
+	if c.session != nil {
+		st.Since = c.registered
+		st.Keepalive = c.session.keepalive.Stats()
+	}
+	if c.serverHello != nil {
+		st.Protocol = min(c.serverHello.GetProtocol(), protomsg.ProtocolVersion)
+		st.ServerVersion = c.serverHello.GetVersion()
+		st.Features = (c.serverHello.FeatureSet() & protomsg.SupportedFeatures).String()
+	}
+	return st
+}
+
+var ErrReconnect = errors.New("reconnect requested")
+
+// Reconnect drops the current registration, Register returns ErrReconnect
+// and the caller registers again.
+func (c *Client) Reconnect() {
+	c.mu.Lock()
+	s := c.session
+	c.mu.Unlock()
+
+	if s != nil {
+		s.reconnect.Store(true)
+		_ = s.Close()
+	}
+}
+
+const (
+	// StreamOut is a stream this client opened to a device
+	StreamOut = "out"
+	// StreamIn is a stream of a requester to a target of this device
+	StreamIn = "in"
+)
+
+type Stream struct {
+	ID        uint64    `json:"id"`
+	Direction string    `json:"direction"`
+	Device    string    `json:"device"`
+	Target    string    `json:"target"`
+	Start     time.Time `json:"start"`
+}
+
+// Streams returns the open streams, oldest first.
+func (c *Client) Streams() []Stream {
+	return c.streams.list()
+}
+
+type streams struct {
+	mu   sync.Mutex
+	next atomic.Uint64
+	open map[uint64]Stream
+}
+
+func (s *streams) track(conn net.Conn, direction, device, target string) net.Conn {
+	st := Stream{
+		ID:        s.next.Add(1),
+		Direction: direction,
+		Device:    device,
+		Target:    target,
+		Start:     time.Now(),
+	}
+
+	s.mu.Lock()
+	if s.open == nil {
+		s.open = make(map[uint64]Stream)
+	}
+	s.open[st.ID] = st
+	s.mu.Unlock()
+
+	return &trackedConn{Conn: conn, done: func() {
+		s.mu.Lock()
+		delete(s.open, st.ID)
+		s.mu.Unlock()
+	}}
+}
+
+func (s *streams) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.open)
+}
+
+func (s *streams) list() []Stream {
+	s.mu.Lock()
+	list := make([]Stream, 0, len(s.open))
+	for _, st := range s.open {
+		list = append(list, st)
+	}
+	s.mu.Unlock()
+
+	slices.SortFunc(list, func(a, b Stream) int { return cmp.Compare(a.ID, b.ID) })
+	return list
+}
+
+type trackedConn struct {
+	net.Conn
+	once sync.Once
+	done func()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.done)
+	return c.Conn.Close()
+}
+
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
@@ -0,0 +1,22 @@
+package tunnelclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// dialUnix opens a socket the device exposes in Sockets.
+func (c *Client) dialUnix(ctx context.Context, name string) (net.Conn, error) {
+	path, ok := c.Sockets[name]
+	if !ok {
+		return nil, fmt.Errorf("unix socket %q is not exposed", name)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", path)
+}
@@ -0,0 +1,39 @@
+package tunnelclient_test
+
+import (
+	"context"
+	"testing"
+
+	tunnelclient "github.com/Asutorufa/tunnel/pkg/client"
+	"github.com/Asutorufa/tunnel/pkg/protomsg"
+	"github.com/Asutorufa/tunnel/pkg/tunneltest"
+)
+
+func TestUnixSocket(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	path := tunneltest.UnixEchoServer(t)
+
+	h.NewDevice("dev1", func(c *tunnelclient.Client) {
+		c.Sockets = map[string]string{"echo": path}
+	})
+
+	conn, err := h.Server.OpenStream(context.Background(), protomsg.NewUnixConnect("dev1", "echo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunneltest.AssertEcho(t, conn)
+	conn.Close()
+
+	// only exposed names, never paths
+	for _, name := range []string{"docker", path} {
+		if _, err := h.Server.OpenStream(context.Background(), protomsg.NewUnixConnect("dev1", name)); err == nil {
+			t.Errorf("%s is not exposed", name)
+		}
+	}
+
+	req := protomsg.NewConnect("dev1", "127.0.0.1", 22)
+	req.GetConnect().Network = "sctp"
+	if _, err := h.Server.OpenStream(context.Background(), req); err == nil {
+		t.Error("expect unsupported network")
+	}
+}
@@ -0,0 +1,445 @@
+// Package config is the config file of the server and the client. Every
+// flag of the binaries is a field of the file, flags given on the command
+// line override it.
+package config
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Asutorufa/tunnel/pkg/fakedns"
+	"github.com/Asutorufa/tunnel/pkg/forward"
+	"github.com/Asutorufa/tunnel/pkg/protomsg"
+)
+
+type Log struct {
+	// Level is debug, info, warn or error
+	Level string `json:"level"`
+}
+
+func (l Log) SlogLevel() (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(l.Level)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", l.Level)
+	}
+	return level, nil
+}
+
+type Keepalive struct {
+	Interval forward.Duration `json:"interval,omitempty"`
+	Timeout  forward.Duration `json:"timeout,omitempty"`
+}
+
+type AccessLog struct {
+	File string `json:"file,omitempty"`
+	// MaxSize in MB
+	MaxSize    int64 `json:"max_size"`
+	MaxBackups int   `json:"max_backups"`
+}
+
+// Proxy is the socks5 and http proxy servers of requesters.
+type Proxy struct {
+	Socks5 string `json:"socks5,omitempty"`
+	HTTP   string `json:"http,omitempty"`
+	// Auth is a credentials file
+	Auth   string `json:"auth,omitempty"`
+	Suffix string `json:"suffix"`
+	Direct bool   `json:"direct,omitempty"`
+	// Routes is a routes file
+	Routes   string `json:"routes,omitempty"`
+	Upstream string `json:"upstream,omitempty"`
+	ExitNode string `json:"exit_node,omitempty"`
+}
+
+type Forward struct {
+	// File is a rule file, a missing one forwards nothing
+	File  string         `json:"file,omitempty"`
+	Rules []forward.Rule `json:"rules,omitempty"`
+}
+
+type Events struct {
+	Webhook       string `json:"webhook,omitempty"`
+	WebhookSecret string `json:"webhook_secret,omitempty"`
+	File          string `json:"file,omitempty"`
+	HTTP          string `json:"http,omitempty"`
+	// HTTPToken is the bearer token of HTTP, the webhook secret when empty
+	HTTPToken string `json:"http_token,omitempty"`
+}
+
+// TLS secures the connection between the client and the server.
+type TLS struct {
+	Enable bool `json:"enable,omitempty"`
+	// Cert and Key are the certificate of the server, or the client
+	// certificate for a server with CA
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+	// CA verifies the other side, a server with CA requires client
+	// certificates and a client without it trusts the system roots
+	CA string `json:"ca,omitempty"`
+	// ServerName and Insecure are only used by the client
+	ServerName string `json:"server_name,omitempty"`
+	Insecure   bool   `json:"insecure,omitempty"`
+}
+
+// ServerConfig is the tls of the server listener, nil when it is disabled.
+func (t TLS) ServerConfig() (*tls.Config, error) {
+	if !t.Enable {
+		return nil, nil
+	}
+	if t.Cert == "" || t.Key == "" {
+		return nil, errors.New("tls: cert and key are required")
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	c := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if t.CA != "" {
+		if c.ClientCAs, err = loadCA(t.CA); err != nil {
+			return nil, err
+		}
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c, nil
+}
+
+// ClientConfig is the tls to server, nil when it is disabled.
+func (t TLS) ClientConfig(server string) (*tls.Config, error) {
+	if !t.Enable {
+		return nil, nil
+	}
+
+	host, _, _ := net.SplitHostPort(server)
+	c := &tls.Config{ServerName: cmp.Or(t.ServerName, host), InsecureSkipVerify: t.Insecure, MinVersion: tls.VersionTLS12}
+
+	if t.Cert != "" || t.Key != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	if t.CA != "" {
+		var err error
+		if c.RootCAs, err = loadCA(t.CA); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func loadCA(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("tls: no certificate in %s", path)
+	}
+	return pool, nil
+}
+
+// Limits are the defaults of forward rules without their own.
+type Limits struct {
+	DialTimeout forward.Duration `json:"dial_timeout,omitempty"`
+	IdleTimeout forward.Duration `json:"idle_timeout,omitempty"`
+	// Bandwidth of each rule in bytes per second
+	Bandwidth forward.Size `json:"bandwidth,omitempty"`
+}
+
+// Apply sets the limits of the rules that don't have them.
+func (l Limits) Apply(rules []forward.Rule) {
+	for i := range rules {
+		r := &rules[i]
+		r.DialTimeout = cmp.Or(r.DialTimeout, l.DialTimeout)
+		r.IdleTimeout = cmp.Or(r.IdleTimeout, l.IdleTimeout)
+		r.Bandwidth = cmp.Or(r.Bandwidth, l.Bandwidth)
+	}
+}
+
+type ServerLimits struct {
+	Limits
+	// HandshakeTimeout bounds how long a new connection may take to send
+	// its first message
+	HandshakeTimeout forward.Duration `json:"handshake_timeout,omitempty"`
+}
+
+type Server struct {
+	Listen    string       `json:"listen"`
+	TLS       TLS          `json:"tls"`
+	Limits    ServerLimits `json:"limits"`
+	Log       Log          `json:"log"`
+	Keepalive Keepalive    `json:"keepalive"`
+	Proxy     Proxy        `json:"proxy"`
+	Forward   Forward      `json:"forward"`
+	Events    Events       `json:"events"`
+	AccessLog AccessLog    `json:"access_log"`
+}
+
+// DefaultServer is the server config before -config and flags, defaults
+// owned by other packages, like the proxy suffix, are set by the command.
+func DefaultServer() *Server {
+	return &Server{
+		Listen: "127.0.0.1:8388",
+		Limits: ServerLimits{HandshakeTimeout: forward.Duration(30 * time.Second)},
+		Log:    Log{Level: "debug"},
+		Keepalive: Keepalive{
+			Interval: forward.Duration(protomsg.DefaultKeepalive.Interval),
+			Timeout:  forward.Duration(protomsg.DefaultKeepalive.Timeout),
+		},
+		Proxy:     Proxy{Socks5: "127.0.0.1:1081"},
+		Forward:   Forward{File: "rule.json"},
+		AccessLog: AccessLog{MaxSize: 100, MaxBackups: 5},
+	}
+}
+
+// Redacted is a copy to print, secrets are masked.
+func (s Server) Redacted() *Server {
+	s.Proxy = s.Proxy.redacted()
+	s.Events.Webhook = redactURL(s.Events.Webhook)
+	if s.Events.WebhookSecret != "" {
+		s.Events.WebhookSecret = redacted
+	}
+	if s.Events.HTTPToken != "" {
+		s.Events.HTTPToken = redacted
+	}
+	return &s
+}
+
+type DNS struct {
+	Listen   string `json:"listen,omitempty"`
+	Upstream string `json:"upstream"`
+	FakeIP   string `json:"fakeip"`
+}
+
+type TUN struct {
+	Name string `json:"name,omitempty"`
+	MTU  int    `json:"mtu"`
+	DNS  string `json:"dns,omitempty"`
+	// Subnets are uuid=prefix[=mapped prefix]
+	Subnets []string `json:"subnets,omitempty"`
+}
+
+// Device is what the client offers to requesters as a device.
+type Device struct {
+	Routes   []string `json:"routes,omitempty"`
+	ExitNode bool     `json:"exit_node,omitempty"`
+	// ExitPolicy is a routes file
+	ExitPolicy string `json:"exit_policy,omitempty"`
+	// Egress is an egress file
+	Egress      string            `json:"egress,omitempty"`
+	UnixSockets map[string]string `json:"unix_sockets,omitempty"`
+}
+
+type Client struct {
+	UUID   string `json:"uuid"`
+	Server string `json:"server"`
+	TLS    TLS    `json:"tls"`
+	Limits Limits `json:"limits"`
+	// Control is the unix socket of client status and the other commands,
+	// empty disables it
+	Control string `json:"control"`
+	// Socks5 and Proxies are the chain to the server, HTTPS_PROXY or
+	// ALL_PROXY are used without them
+	Socks5    string    `json:"socks5,omitempty"`
+	Proxies   []string  `json:"proxies,omitempty"`
+	Log       Log       `json:"log"`
+	Keepalive Keepalive `json:"keepalive"`
+	Proxy     Proxy     `json:"proxy"`
+	Forward   Forward   `json:"forward"`
+	Device    Device    `json:"device"`
+	DNS       DNS       `json:"dns"`
+	TUN       TUN       `json:"tun"`
+	AccessLog AccessLog `json:"access_log"`
+}
+
+// DefaultClient is the client config before -config and flags, the
+// command sets the defaults of the control socket, proxy suffix and mtu.
+func DefaultClient() *Client {
+	return &Client{
+		UUID:      "uuid",
+		Server:    "127.0.0.1:8388",
+		Log:       Log{Level: "debug"},
+		Proxy:     Proxy{Socks5: "127.0.0.1:1081"},
+		Forward:   Forward{File: "rule.json"},
+		DNS:       DNS{Upstream: "1.1.1.1:53", FakeIP: fakedns.DefaultPrefix.String()},
+		AccessLog: AccessLog{MaxSize: 100, MaxBackups: 5},
+	}
+}
+
+func (c Client) Redacted() *Client {
+	c.Proxy = c.Proxy.redacted()
+	c.Socks5 = redactURL(c.Socks5)
+	proxies := make([]string, len(c.Proxies))
+	for i, p := range c.Proxies {
+		proxies[i] = redactURL(p)
+	}
+	c.Proxies = proxies
+	return &c
+}
+
+const redacted = "xxxxx"
+
+func (p Proxy) redacted() Proxy {
+	p.Upstream = redactURL(p.Upstream)
+	return p
+}
+
+func redactURL(s string) string {
+	// a yuhaiin node has its secrets anywhere
+	if strings.HasPrefix(strings.TrimSpace(s), "{") {
+		return redacted
+	}
+
+	scheme, rest, ok := strings.Cut(s, "://")
+	at := strings.LastIndexByte(rest, '@')
+	if !ok || at < 0 {
+		return s
+	}
+
+	user, _, ok := strings.Cut(rest[:at], ":")
+	if !ok {
+		return s
+	}
+	return scheme + "://" + user + ":" + redacted + rest[at:]
+}
+
+// Load decodes a config file over the defaults in v, ${NAME} and
+// ${NAME:-default} are replaced by environment variables first.
+func Load(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	err = Parse(data, v)
+	var errs forward.Errors
+	if errors.As(err, &errs) {
+		for _, e := range errs {
+			e.File = path
+		}
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func Parse(data []byte, v any) error {
+	data, err := ExpandEnv(data)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return forward.Errors{forward.DecodeError(data, "", err)}
+	}
+
+	var rules []forward.Rule
+	switch c := v.(type) {
+	case *Server:
+		rules = c.Forward.Rules
+	case *Client:
+		rules = c.Forward.Rules
+	}
+
+	errs := forward.Validate(rules)
+	for _, e := range errs {
+		e.Path = "forward." + e.Path
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// ExpandEnv replaces ${NAME} and ${NAME:-default}, values are escaped for
+// json strings. A variable that is unset without a default is an error, so
+// a missing secret doesn't become an empty one.
+func ExpandEnv(data []byte) ([]byte, error) {
+	var missing []string
+	data = envPattern.ReplaceAllFunc(data, func(b []byte) []byte {
+		m := envPattern.FindSubmatch(b)
+		name := string(m[1])
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			if m[2] == nil {
+				missing = append(missing, name)
+				return b
+			}
+			value = string(m[3])
+		}
+
+		quoted, _ := json.Marshal(value)
+		return quoted[1 : len(quoted)-1]
+	})
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("environment variables not set: %s", strings.Join(missing, ", "))
+	}
+	return data, nil
+}
+
+// PathFromArgs finds -config in command line args before they are parsed,
+// so the file can be loaded first and the other flags override it.
+func PathFromArgs(args []string) string {
+	value, _ := lookupArg(args, "config", false)
+	return value
+}
+
+// VersionFromArgs finds -version in command line args, so it is answered
+// before a config file that may be broken is loaded.
+func VersionFromArgs(args []string) bool {
+	value, ok := lookupArg(args, "version", true)
+	if !ok {
+		return false
+	}
+	v, err := strconv.ParseBool(cmp.Or(value, "true"))
+	return err == nil && v
+}
+
+// lookupArg returns the value of flag name in args, a bool flag doesn't
+// take the next arg as its value.
+func lookupArg(args []string, name string, isBool bool) (string, bool) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+
+		key, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || key != name {
+			continue
+		}
+		if hasValue || isBool {
+			return value, true
+		}
+		if i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+	return "", false
+}
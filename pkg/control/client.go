@@ -0,0 +1,108 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	tunnelclient "github.com/Asutorufa/tunnel/pkg/client"
+	"github.com/Asutorufa/tunnel/pkg/forward"
+)
+
+// Client talks to the control socket of a running client.
+type Client struct {
+	http *http.Client
+}
+
+func NewClient(path string) *Client {
+	return &Client{http: &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}}
+}
+
+func (c *Client) Status() (tunnelclient.Status, error) {
+	var st tunnelclient.Status
+	err := c.do(http.MethodGet, "/status", nil, &st)
+	return st, err
+}
+
+func (c *Client) Forwards() ([]Forward, error) {
+	var list []Forward
+	err := c.do(http.MethodGet, "/forwards", nil, &list)
+	return list, err
+}
+
+func (c *Client) AddForward(r forward.Rule) (Forward, error) {
+	var f Forward
+	err := c.do(http.MethodPost, "/forwards", r, &f)
+	return f, err
+}
+
+func (c *Client) RemoveForward(listen string) error {
+	return c.do(http.MethodDelete, "/forwards?listen="+url.QueryEscape(listen), nil, nil)
+}
+
+func (c *Client) Streams() ([]tunnelclient.Stream, error) {
+	var list []tunnelclient.Stream
+	err := c.do(http.MethodGet, "/streams", nil, &list)
+	return list, err
+}
+
+func (c *Client) Reconnect() error {
+	return c.do(http.MethodPost, "/reconnect", nil, nil)
+}
+
+func (c *Client) LogLevel() (string, error) {
+	var l LogLevel
+	err := c.do(http.MethodGet, "/log/level", nil, &l)
+	return l.Level, err
+}
+
+func (c *Client) SetLogLevel(level string) error {
+	return c.do(http.MethodPut, "/log/level", LogLevel{Level: level}, nil)
+}
+
+func (c *Client) do(method, path string, body, resp any) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, "http://control"+path, r)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		var e errorResponse
+		if err := json.NewDecoder(res.Body).Decode(&e); err != nil || e.Error == "" {
+			return errors.New(res.Status)
+		}
+		return errors.New(e.Error)
+	}
+
+	if resp == nil || res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
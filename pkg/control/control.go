@@ -0,0 +1,168 @@
+// Package control serves a running client on a local unix socket with http
+// and json, and is the client of that socket for the command line.
+//
+//	GET    /status                 registration, server and keepalive stats
+//	GET    /forwards               forward rules with their connections
+//	POST   /forwards               add a forward rule, the body is a rule
+//	DELETE /forwards?listen=addr   remove the forward rules on a listen address
+//	GET    /streams                open streams
+//	POST   /reconnect              drop the registration, the client registers again
+//	GET    /log/level              the log level
+//	PUT    /log/level              change the log level, the body is {"level": "info"}
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Asutorufa/tunnel/pkg/api"
+	tunnelclient "github.com/Asutorufa/tunnel/pkg/client"
+	"github.com/Asutorufa/tunnel/pkg/forward"
+)
+
+// DefaultPath is the control socket of the client unless configured.
+func DefaultPath() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "tunnel-client.sock")
+	}
+	return filepath.Join(os.TempDir(), "tunnel-client.sock")
+}
+
+type Forward struct {
+	Rule   forward.Rule `json:"rule"`
+	Addr   string       `json:"addr"`
+	Active int64        `json:"active"`
+	Total  uint64       `json:"total"`
+}
+
+type LogLevel struct {
+	Level string `json:"level"`
+}
+
+type Server struct {
+	Client   *tunnelclient.Client
+	Forwards *api.Forwards
+	// Level is changed along with the level of the default logger
+	Level *slog.LevelVar
+}
+
+// Listen serves the control api on a unix socket only the user can open,
+// until the listener is closed.
+func (s *Server) Listen(path string) (net.Listener, error) {
+	lis, err := listenPrivate(path)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := http.Serve(lis, s.Handler()); err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Error("serve control failed", "err", err)
+		}
+	}()
+	return lis, nil
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Client.Status())
+	})
+
+	mux.HandleFunc("GET /forwards", func(w http.ResponseWriter, r *http.Request) {
+		var list []Forward
+		for _, f := range s.Forwards.List() {
+			list = append(list, forwardOf(f))
+		}
+		writeJSON(w, http.StatusOK, list)
+	})
+
+	mux.HandleFunc("POST /forwards", func(w http.ResponseWriter, r *http.Request) {
+		var rule forward.Rule
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&rule); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		f, err := s.Forwards.Add(rule)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, forwardOf(f))
+	})
+
+	mux.HandleFunc("DELETE /forwards", func(w http.ResponseWriter, r *http.Request) {
+		err := s.Forwards.Remove(r.URL.Query().Get("listen"))
+		if errors.Is(err, api.ErrForwardNotFound) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /streams", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Client.Streams())
+	})
+
+	mux.HandleFunc("POST /reconnect", func(w http.ResponseWriter, r *http.Request) {
+		s.Client.Reconnect()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /log/level", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, LogLevel{Level: strings.ToLower(s.Level.Level().String())})
+	})
+
+	mux.HandleFunc("PUT /log/level", func(w http.ResponseWriter, r *http.Request) {
+		var req LogLevel
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(req.Level)); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		s.Level.Set(level)
+		slog.SetLogLoggerLevel(level)
+		slog.Info("log level changed", "level", level)
+		writeJSON(w, http.StatusOK, LogLevel{Level: strings.ToLower(level.String())})
+	})
+
+	return mux
+}
+
+func forwardOf(f *api.Forwarder) Forward {
+	active, total := f.Connections()
+	return Forward{Rule: f.Rule, Addr: f.Addr().String(), Active: active, Total: total}
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, errorResponse{Error: err.Error()})
+}
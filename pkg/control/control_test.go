@@ -0,0 +1,118 @@
+package control_test
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Asutorufa/tunnel/pkg/api"
+	"github.com/Asutorufa/tunnel/pkg/control"
+	"github.com/Asutorufa/tunnel/pkg/forward"
+	"github.com/Asutorufa/tunnel/pkg/tunneltest"
+)
+
+func TestControl(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	h.NewDevice("dev1")
+	port := tunneltest.EchoServer(t)
+
+	c := h.NewDevice("requester")
+	forwards := api.NewForwards(c)
+	defer forwards.Close()
+
+	level := new(slog.LevelVar)
+	defer slog.SetLogLoggerLevel(slog.LevelInfo)
+
+	path := filepath.Join(t.TempDir(), "control.sock")
+	s := &control.Server{Client: c, Forwards: forwards, Level: level}
+	lis, err := s.Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm()&0o077 != 0 {
+		t.Errorf("expect socket only the user can open, got %v", fi.Mode())
+	}
+
+	cc := control.NewClient(path)
+
+	st, err := cc.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.Registered || st.UUID != "requester" || st.Server != h.Addr {
+		t.Errorf("unexpected status %+v", st)
+	}
+
+	f, err := cc.AddForward(forward.Rule{Listen: "127.0.0.1:0", UUID: "dev1", Address: "127.0.0.1", Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cc.AddForward(forward.Rule{Listen: "127.0.0.1:0", UUID: "dev1"}); err == nil {
+		t.Error("expect a rule without port refused")
+	}
+
+	conn, err := net.Dial("tcp", f.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunneltest.AssertEcho(t, conn)
+
+	list, err := cc.Forwards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Active != 1 || list[0].Total != 1 {
+		t.Errorf("unexpected forwards %+v", list)
+	}
+
+	streams, err := cc.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 1 || streams[0].Device != "dev1" {
+		t.Errorf("unexpected streams %+v", streams)
+	}
+
+	conn.Close()
+	tunneltest.Eventually(t, func() bool {
+		streams, _ := cc.Streams()
+		return len(streams) == 0
+	}, "stream closed")
+
+	if err := cc.RemoveForward(f.Addr); err == nil {
+		t.Error("expect listen address of the rule, not the bound address")
+	}
+	if err := cc.RemoveForward("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.DialTimeout("tcp", f.Addr, time.Second); err == nil {
+		t.Error("expect removed forward closed")
+	}
+
+	if err := cc.SetLogLevel("warn"); err != nil {
+		t.Fatal(err)
+	}
+	if level.Level() != slog.LevelWarn {
+		t.Errorf("expect warn, got %s", level.Level())
+	}
+	if err := cc.SetLogLevel("loud"); err == nil {
+		t.Error("expect invalid level refused")
+	}
+
+	if err := cc.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	tunneltest.Eventually(t, func() bool {
+		next, err := cc.Status()
+		return err == nil && next.Registered && next.Since.After(st.Since)
+	}, "registered again")
+}
@@ -0,0 +1,22 @@
+//go:build !unix
+
+package control
+
+import (
+	"net"
+	"os"
+
+	"github.com/Asutorufa/tunnel/pkg/api"
+)
+
+func listenPrivate(path string) (net.Listener, error) {
+	lis, err := api.ListenUnix(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		lis.Close()
+		return nil, err
+	}
+	return lis, nil
+}
@@ -0,0 +1,24 @@
+//go:build unix
+
+package control
+
+import (
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/Asutorufa/tunnel/pkg/api"
+)
+
+var umaskMu sync.Mutex
+
+// listenPrivate creates the socket under umask 077, so it is never open to
+// other users, not even before a chmod.
+func listenPrivate(path string) (net.Listener, error) {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+
+	old := syscall.Umask(0o077)
+	defer syscall.Umask(old)
+	return api.ListenUnix(path)
+}
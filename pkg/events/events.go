@@ -0,0 +1,40 @@
+// Package events delivers tunnel server events to webhooks, files and
+// http subscribers.
+package events
+
+import (
+	"log/slog"
+
+	tunnelserver "github.com/Asutorufa/tunnel/pkg/server"
+)
+
+type Sink interface {
+	Send(tunnelserver.Event)
+	Close() error
+}
+
+// Dispatch sends every event of s to the sinks until the returned func is
+// called, the returned func also closes the sinks.
+func Dispatch(s *tunnelserver.Server, sinks ...Sink) func() {
+	events, unsubscribe := s.Subscribe()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range events {
+			for _, sink := range sinks {
+				sink.Send(e)
+			}
+		}
+	}()
+
+	return func() {
+		unsubscribe()
+		<-done
+		for _, sink := range sinks {
+			if err := sink.Close(); err != nil {
+				slog.Error("close event sink failed", "err", err)
+			}
+		}
+	}
+}
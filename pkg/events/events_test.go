@@ -0,0 +1,142 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tunnelserver "github.com/Asutorufa/tunnel/pkg/server"
+	"github.com/Asutorufa/tunnel/pkg/tunneltest"
+)
+
+func TestDispatch(t *testing.T) {
+	h := tunneltest.NewServer(t)
+
+	var attempts atomic.Int32
+	received := make(chan tunnelserver.Event, 10)
+	webhookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !Verify("secret", body, r.Header.Get(SignatureHeader)) {
+			t.Errorf("invalid signature: %s", r.Header.Get(SignatureHeader))
+		}
+
+		// the first delivery fails and must be retried
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var e tunnelserver.Event
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Error(err)
+		}
+		received <- e
+	}))
+	defer webhookServer.Close()
+
+	webhook := NewWebhook(webhookServer.URL, "secret")
+	webhook.Backoff = time.Millisecond * 10
+
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	file, err := NewFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub := NewHub(100)
+	hub.Token = "token"
+	hubServer := httptest.NewServer(hub)
+	defer hubServer.Close()
+
+	stop := Dispatch(h.Server, webhook, file, hub)
+
+	h.NewDevice("dev1")
+
+	select {
+	case e := <-received:
+		if e.Type != tunnelserver.EventRegistered || e.UUID != "dev1" {
+			t.Fatalf("unexpected webhook event: %+v", e)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("webhook not delivered")
+	}
+
+	resp, err := http.Get(hubServer.URL + "?since=0&timeout=5s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expect 401 without token, got %s", resp.Status)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, hubServer.URL+"?since=0&timeout=5s", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []Entry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(entries) != 1 || entries[0].ID != 1 || entries[0].Type != tunnelserver.EventRegistered {
+		t.Fatalf("unexpected long-poll entries: %+v", entries)
+	}
+
+	stop()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"type":"registered","uuid":"dev1"`) {
+		t.Fatalf("unexpected file content: %s", data)
+	}
+}
+
+func TestHubSSE(t *testing.T) {
+	hub := NewHub(2)
+	hub.Send(tunnelserver.Event{Type: tunnelserver.EventRegistered, UUID: "dev1"})
+	hub.Send(tunnelserver.Event{Type: tunnelserver.EventDisconnected, UUID: "dev1"})
+
+	server := httptest.NewServer(hub)
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Last-Event-ID", "1")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	go hub.Send(tunnelserver.Event{Type: tunnelserver.EventRegistered, UUID: "dev2"})
+
+	r := bufio.NewReader(resp.Body)
+	var ids []string
+	for len(ids) < 2 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id, ok := strings.CutPrefix(line, "id: "); ok {
+			ids = append(ids, strings.TrimSpace(id))
+		}
+	}
+
+	if ids[0] != "2" || ids[1] != "3" {
+		t.Fatalf("unexpected ids: %v", ids)
+	}
+}
@@ -0,0 +1,41 @@
+package events
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+
+	tunnelserver "github.com/Asutorufa/tunnel/pkg/server"
+)
+
+// File appends every event as a json line.
+type File struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func NewFile(path string) (*File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (f *File) Send(e tunnelserver.Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.enc.Encode(e); err != nil {
+		slog.Error("write event failed", "file", f.f.Name(), "err", err)
+	}
+}
+
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.f.Close()
+}
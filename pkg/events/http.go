@@ -0,0 +1,180 @@
+package events
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tunnelserver "github.com/Asutorufa/tunnel/pkg/server"
+)
+
+type Entry struct {
+	ID uint64 `json:"id"`
+	tunnelserver.Event
+}
+
+// Hub keeps the latest events in memory and serves them over http.
+//
+//	GET /events?since=10&timeout=30s   long-poll, json array of events after id 10
+//	GET /events (Accept: text/event-stream)   server-sent events, honors Last-Event-ID
+type Hub struct {
+	// Token is required as "Authorization: Bearer <token>" unless empty
+	Token string
+
+	mu     sync.Mutex
+	size   int
+	seq    uint64
+	events []Entry
+	notify chan struct{}
+}
+
+func NewHub(size int) *Hub {
+	return &Hub{
+		size:   size,
+		notify: make(chan struct{}),
+	}
+}
+
+func (h *Hub) Send(e tunnelserver.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq++
+	h.events = append(h.events, Entry{ID: h.seq, Event: e})
+	if len(h.events) > h.size {
+		h.events = h.events[len(h.events)-h.size:]
+	}
+
+	close(h.notify)
+	h.notify = make(chan struct{})
+}
+
+func (h *Hub) Close() error { return nil }
+
+// Since returns the events after id and a channel closed on the next event.
+func (h *Hub) Since(id uint64) ([]Entry, <-chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var entries []Entry
+	for _, e := range h.events {
+		if e.ID > id {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries, h.notify
+}
+
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.Token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="events"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	since, err := parseSince(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		h.serveSSE(w, r, since)
+	} else {
+		h.serveLongPoll(w, r, since)
+	}
+}
+
+func parseSince(r *http.Request) (uint64, error) {
+	since := r.URL.Query().Get("since")
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		since = id
+	}
+	if since == "" {
+		return 0, nil
+	}
+
+	id, err := strconv.ParseUint(since, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid since: %w", err)
+	}
+	return id, nil
+}
+
+func (h *Hub) serveLongPoll(w http.ResponseWriter, r *http.Request, since uint64) {
+	timeout := time.Second * 30
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			http.Error(w, "invalid timeout: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		timeout = min(d, time.Minute*5)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	entries, notify := h.Since(since)
+	for len(entries) == 0 {
+		select {
+		case <-notify:
+			entries, notify = h.Since(since)
+		case <-timer.C:
+			entries = []Entry{}
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(entries)
+}
+
+func (h *Hub) serveSSE(w http.ResponseWriter, r *http.Request, since uint64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		entries, notify := h.Since(since)
+		for _, e := range entries {
+			data, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data); err != nil {
+				return
+			}
+			since = e.ID
+		}
+		flusher.Flush()
+
+		select {
+		case <-notify:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
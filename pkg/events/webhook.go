@@ -0,0 +1,142 @@
+package events
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	tunnelserver "github.com/Asutorufa/tunnel/pkg/server"
+)
+
+const SignatureHeader = "X-Tunnel-Signature"
+
+// Webhook posts every event as json to URL. With a Secret the body is signed
+// with hmac-sha256 in the X-Tunnel-Signature header as "sha256=<hex>".
+type Webhook struct {
+	URL     string
+	Secret  string
+	Retries int
+	// Backoff before the first retry, doubled on every retry
+	Backoff time.Duration
+	Client  *http.Client
+
+	queue chan tunnelserver.Event
+	done  chan struct{}
+	wg    sync.WaitGroup
+	once  sync.Once
+}
+
+func NewWebhook(url, secret string) *Webhook {
+	w := &Webhook{
+		URL:     url,
+		Secret:  secret,
+		Retries: 5,
+		Backoff: time.Second,
+		Client:  &http.Client{Timeout: time.Second * 10},
+		queue:   make(chan tunnelserver.Event, 256),
+		done:    make(chan struct{}),
+	}
+
+	w.wg.Add(1)
+	go w.loop()
+
+	return w
+}
+
+func (w *Webhook) Send(e tunnelserver.Event) {
+	select {
+	case w.queue <- e:
+	default:
+		slog.Warn("webhook queue is full, drop event", "type", e.Type, "uuid", e.UUID)
+	}
+}
+
+func (w *Webhook) loop() {
+	defer w.wg.Done()
+
+	for {
+		select {
+		case e := <-w.queue:
+			if err := w.deliver(e); err != nil {
+				slog.Error("deliver webhook failed", "url", w.URL, "type", e.Type, "err", err)
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *Webhook) deliver(e tunnelserver.Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	backoff := w.Backoff
+	for attempt := 0; ; attempt++ {
+		err = w.post(e, body)
+		if err == nil || attempt >= w.Retries {
+			return err
+		}
+
+		slog.Warn("deliver webhook failed, retry", "url", w.URL, "attempt", attempt+1, "err", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-w.done:
+			return err
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+func (w *Webhook) post(e tunnelserver.Event, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tunnel-Event", e.Type.String())
+	if w.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(w.Secret, body))
+	}
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (w *Webhook) Close() error {
+	w.once.Do(func() { close(w.done) })
+	w.wg.Wait()
+	return nil
+}
+
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a X-Tunnel-Signature header, for webhook receivers written in go.
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
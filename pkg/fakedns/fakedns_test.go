@@ -0,0 +1,129 @@
+package fakedns
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestPool(t *testing.T) {
+	p, err := NewPool(netip.MustParsePrefix("10.0.0.0/30"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := p.Addr("a.dev1.tunnel.")
+	if a != netip.MustParseAddr("10.0.0.1") || p.Addr("A.dev1.tunnel") != a {
+		t.Fatalf("unexpected address %s", a)
+	}
+
+	b := p.Addr("b.dev1.tunnel")
+	if b != netip.MustParseAddr("10.0.0.2") {
+		t.Fatalf("unexpected address %s", b)
+	}
+
+	// 10.0.0.3 is the broadcast address, the pool wraps and reuses a
+	c := p.Addr("c.dev1.tunnel")
+	if c != a {
+		t.Fatalf("expect %s to be reused, got %s", a, c)
+	}
+
+	if name, ok := p.Name(c); !ok || name != "c.dev1.tunnel" {
+		t.Fatalf("unexpected name %q", name)
+	}
+	if p.Addr("a.dev1.tunnel") != b {
+		t.Fatal("a should get the next address after it was evicted")
+	}
+
+	if _, err := NewPool(netip.MustParsePrefix("10.0.0.0/31")); err == nil {
+		t.Fatal("expect error for a too small prefix")
+	}
+}
+
+func TestServer(t *testing.T) {
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// echo the query back as the answer of the upstream
+			_, _ = upstream.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	pool, err := NewPool(DefaultPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		Pool:     pool,
+		Match:    func(name string) bool { return strings.HasSuffix(name, ".tunnel.") },
+		Upstream: upstream.LocalAddr().String(),
+	}
+
+	resp, err := s.Handle(query(t, "db.dev1.tunnel.", dnsmessage.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Answers) != 1 {
+		t.Fatalf("expect one answer, got %v", msg.Answers)
+	}
+
+	addr := netip.AddrFrom4(msg.Answers[0].Body.(*dnsmessage.AResource).A)
+	if name, ok := pool.Name(addr); !ok || name != "db.dev1.tunnel" {
+		t.Fatalf("unexpected mapping %s -> %q", addr, name)
+	}
+
+	resp, err = s.Handle(query(t, "db.dev1.tunnel.", dnsmessage.TypeAAAA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Unpack(resp); err != nil || len(msg.Answers) != 0 || msg.RCode != dnsmessage.RCodeSuccess {
+		t.Fatalf("expect empty answer, got %v %v", msg, err)
+	}
+
+	q := query(t, "example.com.", dnsmessage.TypeA)
+	resp, err = s.Handle(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != string(q) {
+		t.Fatal("expect the query to be forwarded")
+	}
+}
+
+func query(t *testing.T, name string, typ dnsmessage.Type) []byte {
+	t.Helper()
+
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  typ,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+
+	data, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
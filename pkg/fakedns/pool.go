@@ -0,0 +1,91 @@
+// Package fakedns answers tunnel names with addresses from a reserved range
+// and maps the addresses back to the names when a stream is opened.
+package fakedns
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// DefaultPrefix is reserved for benchmarking by rfc 2544 and is not routed
+// on the internet.
+var DefaultPrefix = netip.MustParsePrefix("198.18.0.0/15")
+
+// Pool hands out addresses of a prefix in order, when it runs out the oldest
+// mapping is reused.
+type Pool struct {
+	prefix netip.Prefix
+
+	mu     sync.Mutex
+	next   netip.Addr
+	byName map[string]netip.Addr
+	byAddr map[netip.Addr]string
+}
+
+func NewPool(prefix netip.Prefix) (*Pool, error) {
+	prefix = prefix.Masked()
+	if !prefix.IsValid() || prefix.Addr().BitLen()-prefix.Bits() < 2 {
+		return nil, fmt.Errorf("fake ip prefix %s is too small", prefix)
+	}
+
+	return &Pool{
+		prefix: prefix,
+		next:   prefix.Addr().Next(),
+		byName: make(map[string]netip.Addr),
+		byAddr: make(map[netip.Addr]string),
+	}, nil
+}
+
+func (p *Pool) Prefix() netip.Prefix { return p.prefix }
+
+func (p *Pool) Contains(addr netip.Addr) bool { return p.prefix.Contains(addr.Unmap()) }
+
+// Addr returns the address of name, a new one is assigned the first time.
+func (p *Pool) Addr(name string) netip.Addr {
+	name = normalize(name)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if addr, ok := p.byName[name]; ok {
+		return addr
+	}
+
+	addr := p.next
+	p.next = addr.Next()
+	if !p.prefix.Contains(p.next) || p.next == lastAddr(p.prefix) {
+		p.next = p.prefix.Addr().Next()
+	}
+
+	if old, ok := p.byAddr[addr]; ok {
+		delete(p.byName, old)
+	}
+
+	p.byName[name] = addr
+	p.byAddr[addr] = name
+	return addr
+}
+
+// Name returns the name that addr was assigned to.
+func (p *Pool) Name(addr netip.Addr) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	name, ok := p.byAddr[addr.Unmap()]
+	return name, ok
+}
+
+func normalize(name string) string { return strings.ToLower(strings.TrimSuffix(name, ".")) }
+
+// lastAddr is the broadcast address of an ipv4 prefix, it is skipped so
+// that no application treats a fake ip as broadcast.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
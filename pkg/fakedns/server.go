@@ -0,0 +1,146 @@
+package fakedns
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Server is a udp dns server, names accepted by Match are answered from
+// Pool and all other queries are forwarded to Upstream.
+type Server struct {
+	Pool  *Pool
+	Match func(name string) bool
+	// Upstream resolver, host:port
+	Upstream string
+	// TTL of fake answers, kept short so that clients ask again after the
+	// mapping could be reused
+	TTL uint32
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(pc)
+}
+
+func (s *Server) Serve(pc net.PacketConn) error {
+	defer pc.Close()
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			resp, err := s.Handle(query)
+			if err != nil {
+				slog.Error("dns query failed", "from", addr, "err", err)
+				return
+			}
+			if _, err := pc.WriteTo(resp, addr); err != nil {
+				slog.Error("write dns response failed", "to", addr, "err", err)
+			}
+		}()
+	}
+}
+
+// Handle returns the response to a dns message.
+func (s *Server) Handle(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+
+	question, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.Match(question.Name.String()) {
+		return s.forward(query)
+	}
+
+	return s.answer(header, question)
+}
+
+func (s *Server) answer(header dnsmessage.Header, question dnsmessage.Question) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+	})
+	b.EnableCompression()
+
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(question); err != nil {
+		return nil, err
+	}
+
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+
+	addr := s.Pool.Addr(question.Name.String())
+	rh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: s.ttl()}
+
+	// other types get an empty answer, so that clients fall back to the a record
+	switch {
+	case question.Type == dnsmessage.TypeA && addr.Is4():
+		if err := b.AResource(rh, dnsmessage.AResource{A: addr.As4()}); err != nil {
+			return nil, err
+		}
+	case question.Type == dnsmessage.TypeAAAA && addr.Is6():
+		if err := b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: addr.As16()}); err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Finish()
+}
+
+func (s *Server) ttl() uint32 {
+	if s.TTL == 0 {
+		return 10
+	}
+	return s.TTL
+}
+
+func (s *Server) forward(query []byte) ([]byte, error) {
+	if s.Upstream == "" {
+		return nil, errors.New("no upstream resolver")
+	}
+
+	conn, err := net.Dial("udp", s.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
@@ -0,0 +1,87 @@
+package forward
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+)
+
+// ValidateCommand checks a rule file and prints every problem, it is the
+// validate subcommand of prog:
+//
+//	client validate rule.json
+func ValidateCommand(prog string, args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s validate [rule.json]\n", prog)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	path := "rule.json"
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		path = fs.Arg(0)
+	default:
+		fs.Usage()
+		return 2
+	}
+
+	c, err := Load(path)
+	if err != nil {
+		var errs Errors
+		if errors.As(err, &errs) {
+			for _, e := range errs {
+				fmt.Fprintln(os.Stderr, e)
+			}
+		} else {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return 1
+	}
+
+	fmt.Printf("%s: ok, version %d, %d rules\n", path, c.Version, len(c.Rules))
+	return 0
+}
+
+// LoadRules is the rules of a binary, the rules of its config followed by
+// the rule file at path, no file forwards only the config rules. Both are
+// checked together so they can't listen on the same address.
+func LoadRules(rules []Rule, path string) ([]Rule, error) {
+	n := len(rules)
+	all := slices.Clip(rules)
+	if path != "" {
+		c, err := Load(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			slog.Warn("no rule file", "file", path)
+		case err != nil:
+			return nil, err
+		default:
+			all = append(all, c.Rules...)
+		}
+	}
+
+	errs := validate(all, func(i int) string {
+		if i < n {
+			return fmt.Sprintf("forward.rules[%d]", i)
+		}
+		return fmt.Sprintf("rules[%d]", i-n)
+	})
+	for _, e := range errs {
+		if strings.HasPrefix(e.Path, "rules[") {
+			e.File = path
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return all, nil
+}
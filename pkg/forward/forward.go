@@ -0,0 +1,290 @@
+// Package forward is the schema of forward rules, the rule.json of the
+// server and the client. Version 2 is a list of rules with options, files
+// without a version are the old map from listen address to target.
+package forward
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/Asutorufa/tunnel/pkg/protomsg"
+)
+
+const Version = 2
+
+// Config of forward rules:
+//
+//	{
+//	  "version": 2,
+//	  "rules": [
+//	    {"listen": "127.0.0.1:2222", "uuid": "uuid1", "port": 22, "description": "ssh"},
+//	    {"listen": "127.0.0.1:5353", "network": "udp", "uuid": "uuid1", "address": "10.0.0.1", "port": 53},
+//	    {"listen": "unix:/tmp/docker.sock", "network": "unix", "uuid": "uuid1", "address": "docker"}
+//	  ]
+//	}
+type Config struct {
+	// Version is 1 for the old format
+	Version int    `json:"version"`
+	Rules   []Rule `json:"rules"`
+}
+
+const (
+	NetworkTCP  = "tcp"
+	NetworkUDP  = protomsg.NetworkUDP
+	NetworkUnix = protomsg.NetworkUnix
+)
+
+type Rule struct {
+	// Listen is a tcp or udp address, or unix: and a socket path
+	Listen string `json:"listen"`
+	// Network is tcp when empty, udp or unix. A unix rule opens the socket
+	// the device exposes as Address, its listener can still be tcp
+	Network string `json:"network,omitempty"`
+	// UUID of the device, it can be empty for an ip address that the
+	// server routes by advertised prefixes
+	UUID    string `json:"uuid"`
+	Address string `json:"address,omitempty"`
+	Port    uint16 `json:"port,omitempty"`
+
+	Description string `json:"description,omitempty"`
+	// Enabled defaults to true
+	Enabled *bool `json:"enabled,omitempty"`
+
+	DialTimeout Duration `json:"dial_timeout,omitempty"`
+	// IdleTimeout closes streams without traffic in both directions, udp
+	// sessions default to a minute
+	IdleTimeout Duration `json:"idle_timeout,omitempty"`
+	// Bandwidth limits all streams of the rule together in bytes per second
+	Bandwidth Size `json:"bandwidth,omitempty"`
+	// ProxyProtocol sends a PROXY protocol header, v1 or v2, with the address
+	// of the local client to the target
+	ProxyProtocol string `json:"proxy_protocol,omitempty"`
+	// TLS terminates tls on the listener
+	TLS *TLS `json:"tls,omitempty"`
+}
+
+type TLS struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+func (r Rule) IsEnabled() bool { return r.Enabled == nil || *r.Enabled }
+
+func (r Rule) Target() protomsg.Target {
+	return protomsg.Target{UUID: r.UUID, Address: r.Address, Port: r.Port, Network: r.Network}
+}
+
+// FromTargets converts the old format, rules are sorted by listen address.
+func FromTargets(targets map[string]protomsg.Target) []Rule {
+	var rules []Rule
+	for _, listen := range slices.Sorted(maps.Keys(targets)) {
+		t := targets[listen]
+		rules = append(rules, Rule{
+			Listen:  listen,
+			Network: t.Network,
+			UUID:    t.UUID,
+			Address: t.Address,
+			Port:    t.Port,
+		})
+	}
+	return rules
+}
+
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := Parse(data)
+	var errs Errors
+	if errors.As(err, &errs) {
+		for _, e := range errs {
+			e.File = path
+		}
+	}
+	return c, err
+}
+
+// Parse decodes and validates a config, all problems are returned as Errors.
+func Parse(data []byte) (*Config, error) {
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(data, &top); err != nil {
+		return nil, Errors{DecodeError(data, "", err)}
+	}
+
+	if _, ok := top["version"]; !ok {
+		return parseLegacy(data)
+	}
+
+	c := &Config{}
+	var errs Errors
+
+	if err := json.Unmarshal(top["version"], &c.Version); err != nil {
+		errs = append(errs, DecodeError(data, "version", err))
+	} else if c.Version != Version {
+		errs = append(errs, &Error{Path: "version", Msg: fmt.Sprintf("unsupported version %d, expect %d", c.Version, Version)})
+	}
+
+	var rules []json.RawMessage
+	if err := json.Unmarshal(top["rules"], &rules); err != nil && top["rules"] != nil {
+		errs = append(errs, DecodeError(data, "rules", err))
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(top)) {
+		if key != "version" && key != "rules" {
+			errs = append(errs, &Error{Path: key, Msg: "unknown field"})
+		}
+	}
+
+	for i, raw := range rules {
+		path := fmt.Sprintf("rules[%d]", i)
+
+		var r Rule
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&r); err != nil {
+			e := DecodeError(raw, path, err)
+			if e.Path == path {
+				e.Path = joinPath(path, failingField(raw))
+			}
+			errs = append(errs, e)
+			continue
+		}
+		c.Rules = append(c.Rules, r)
+	}
+
+	// indexes only match when every rule decoded
+	if len(c.Rules) == len(rules) {
+		errs = append(errs, Validate(c.Rules)...)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return c, nil
+}
+
+func parseLegacy(data []byte) (*Config, error) {
+	var targets map[string]protomsg.Target
+	if err := json.Unmarshal(data, &targets); err != nil {
+		return nil, Errors{DecodeError(data, "", err)}
+	}
+
+	c := &Config{Version: 1, Rules: FromTargets(targets)}
+
+	// the rules are sorted, point to the keys of the old format
+	errs := Validate(c.Rules)
+	for _, e := range errs {
+		if i, field, ok := splitRulePath(e.Path); ok {
+			e.Path = strings.TrimSuffix(fmt.Sprintf("%q.%s", c.Rules[i].Listen, field), ".")
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return c, nil
+}
+
+func splitRulePath(path string) (int, string, bool) {
+	var i int
+	if _, err := fmt.Sscanf(path, "rules[%d]", &i); err != nil {
+		return 0, "", false
+	}
+	_, field, _ := strings.Cut(path, ".")
+	return i, field, true
+}
+
+// Error is a problem at a location of the config, like rules[2].port.
+type Error struct {
+	File string
+	Path string
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		b.WriteString(e.File)
+		b.WriteString(": ")
+	}
+	if e.Path != "" {
+		b.WriteString(e.Path)
+		b.WriteString(": ")
+	}
+	b.WriteString(e.Msg)
+	return b.String()
+}
+
+type Errors []*Error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// DecodeError locates an error of encoding/json in data, under path.
+func DecodeError(data []byte, path string, err error) *Error {
+	var syntax *json.SyntaxError
+	if errors.As(err, &syntax) {
+		line, col := position(data, syntax.Offset)
+		return &Error{Path: joinPath(path, fmt.Sprintf("line %d col %d", line, col)), Msg: syntax.Error()}
+	}
+
+	var typ *json.UnmarshalTypeError
+	if errors.As(err, &typ) {
+		return &Error{Path: joinPath(path, typ.Field), Msg: fmt.Sprintf("expect %s, got %s", typ.Type, typ.Value)}
+	}
+
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return &Error{Path: joinPath(path, strings.Trim(field, `"`)), Msg: "unknown field"}
+	}
+
+	return &Error{Path: path, Msg: strings.TrimPrefix(err.Error(), "json: ")}
+}
+
+// failingField finds the field of a rule that fails to decode, for errors
+// of custom types that don't carry it.
+func failingField(raw []byte) string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return ""
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(fields)) {
+		one, _ := json.Marshal(map[string]json.RawMessage{key: fields[key]})
+		var r Rule
+		if err := json.Unmarshal(one, &r); err != nil {
+			return key
+		}
+	}
+	return ""
+}
+
+func joinPath(path, field string) string {
+	if path == "" || field == "" {
+		return path + field
+	}
+	return path + "." + field
+}
+
+func position(data []byte, offset int64) (line, col int) {
+	line, col = 1, 1
+	for _, b := range data[:min(int(offset), len(data))] {
+		if b == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return line, col
+}
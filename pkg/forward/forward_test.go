@@ -0,0 +1,127 @@
+package forward
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	c, err := Parse([]byte(`{
+		"version": 2,
+		"rules": [
+			{"listen": "127.0.0.1:2222", "uuid": "uuid1", "port": 22, "description": "ssh", "idle_timeout": "5m", "bandwidth": "1M", "proxy_protocol": "v2"},
+			{"listen": "127.0.0.1:5353", "network": "udp", "uuid": "uuid1", "address": "10.0.0.1", "port": 53, "dial_timeout": "3s"},
+			{"listen": "unix:/tmp/docker.sock", "network": "unix", "uuid": "uuid1", "address": "docker"},
+			{"listen": "127.0.0.1:2222", "address": "192.168.1.10", "port": 22, "enabled": false}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Version != Version || len(c.Rules) != 4 {
+		t.Fatalf("unexpected config %+v", c)
+	}
+
+	ssh := c.Rules[0]
+	if ssh.IdleTimeout != Duration(5*time.Minute) || ssh.Bandwidth != 1<<20 || ssh.Description != "ssh" {
+		t.Errorf("unexpected rule %+v", ssh)
+	}
+	if c.Rules[1].DialTimeout != Duration(3*time.Second) {
+		t.Errorf("unexpected dial timeout %v", c.Rules[1].DialTimeout)
+	}
+	if !c.Rules[2].IsEnabled() || c.Rules[3].IsEnabled() {
+		t.Errorf("unexpected enabled")
+	}
+}
+
+func TestParseLegacy(t *testing.T) {
+	c, err := Parse([]byte(`{
+		"127.0.0.1:2222": {"uuid": "uuid1", "address": "127.0.0.1", "port": 22},
+		"127.0.0.1:1111": {"uuid": "uuid1", "port": 80}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Version != 1 || len(c.Rules) != 2 || c.Rules[0].Listen != "127.0.0.1:1111" || c.Rules[1].Port != 22 {
+		t.Errorf("unexpected config %+v", c)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tt := range []struct {
+		data  string
+		paths []string
+	}{
+		{`{"version": 2, "rules": [{"listen": "127.0.0.1:1", "uuid": "a"`, []string{"line 1 col 63"}},
+		{`{"version": 3}`, []string{"version"}},
+		{`{"version": 2, "rule": []}`, []string{"rule"}},
+		{`{"version": 2, "rules": [{"listen": "127.0.0.1:1", "uuid": "a", "port": "22"}]}`, []string{"rules[0].port"}},
+		{`{"version": 2, "rules": [{"listen": "127.0.0.1:1", "uuid": "a", "port": 22, "idle": "1m"}]}`, []string{"rules[0].idle"}},
+		{`{"version": 2, "rules": [{"listen": "127.0.0.1:1", "uuid": "a", "port": 22, "idle_timeout": "1 minute"}]}`, []string{"rules[0].idle_timeout"}},
+		{`{"version": 2, "rules": [
+			{"listen": "127.0.0.1:1", "uuid": "a", "port": 22},
+			{"listen": "127.0.0.1:1", "port": 22, "proxy_protocol": "v3"},
+			{"listen": "127.0.0.1", "network": "udp", "uuid": "a", "port": 53, "tls": {"cert": "a.pem"}},
+			{"listen": "unix:/tmp/a.sock", "network": "unix", "uuid": "a", "port": 22}
+		]}`, []string{
+			"rules[1].uuid", "rules[1].listen", "rules[1].proxy_protocol",
+			"rules[2].listen", "rules[2].tls",
+			"rules[3].address", "rules[3].port",
+		}},
+		{`{"version": 2, "rules": [
+			{"listen": "127.0.0.1:1", "network": "unix", "uuid": "a", "address": "docker"},
+			{"listen": "127.0.0.1:1", "uuid": "a", "port": 22},
+			{"listen": "127.0.0.1:1", "network": "udp", "uuid": "a", "port": 53}
+		]}`, []string{"rules[1].listen"}},
+		{`{"127.0.0.1:2222": {"address": "db"}}`, []string{`"127.0.0.1:2222".port`, `"127.0.0.1:2222".uuid`}},
+	} {
+		_, err := Parse([]byte(tt.data))
+
+		var errs Errors
+		if !errors.As(err, &errs) {
+			t.Errorf("expect errors for %s, got %v", tt.data, err)
+			continue
+		}
+
+		var paths []string
+		for _, e := range errs {
+			paths = append(paths, e.Path)
+		}
+		if !slices.Equal(paths, tt.paths) {
+			t.Errorf("expect %q, got %q", tt.paths, paths)
+		}
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	dir := t.TempDir()
+	config := []Rule{{Listen: "127.0.0.1:2222", UUID: "uuid1", Port: 22}}
+	if rules, err := LoadRules(config, filepath.Join(dir, "rule.json")); err != nil || len(rules) != 1 {
+		t.Errorf("expect the config rules without a file, got %v %v", rules, err)
+	}
+
+	path := filepath.Join(dir, "bad.json")
+	if err := os.WriteFile(path, []byte(`{"version": 2, "rules": [{"listen": "127.0.0.1:1"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var errs Errors
+	if _, err := LoadRules(nil, path); !errors.As(err, &errs) || errs[0].File != path {
+		t.Errorf("expect errors of %s, got %v", path, err)
+	}
+
+	path = filepath.Join(dir, "rule.json")
+	if err := os.WriteFile(path, []byte(`{"version": 2, "rules": [{"listen": "127.0.0.1:2222", "uuid": "uuid2", "port": 22}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := LoadRules(config, path)
+	want := path + ": rules[0].listen: 127.0.0.1:2222 is also used by forward.rules[0]"
+	if err == nil || err.Error() != want {
+		t.Errorf("expect %q, got %v", want, err)
+	}
+}
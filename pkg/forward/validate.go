@@ -0,0 +1,137 @@
+package forward
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Validate checks every rule, the paths of the errors are rules[i].field.
+func Validate(rules []Rule) Errors {
+	return validate(rules, func(i int) string { return fmt.Sprintf("rules[%d]", i) })
+}
+
+// validate is Validate with the path of every rule from name.
+func validate(rules []Rule, name func(int) string) Errors {
+	var errs Errors
+	listens := map[string]int{}
+
+	for i, r := range rules {
+		path := name(i)
+		add := func(field, format string, args ...any) {
+			errs = append(errs, &Error{Path: joinPath(path, field), Msg: fmt.Sprintf(format, args...)})
+		}
+
+		network := r.Network
+		if network == "" {
+			network = NetworkTCP
+		}
+
+		switch network {
+		case NetworkTCP, NetworkUDP:
+			if r.Port == 0 {
+				add("port", "required for %s", network)
+			}
+			if r.UUID == "" {
+				if _, err := netip.ParseAddr(r.Address); err != nil {
+					add("uuid", "required unless address is an ip routed by the server")
+				}
+			}
+		case NetworkUnix:
+			if r.Address == "" {
+				add("address", "required, the name of a socket the device exposes")
+			}
+			if r.Port != 0 {
+				add("port", "not used for unix")
+			}
+			if r.UUID == "" {
+				add("uuid", "required for unix")
+			}
+		default:
+			add("network", "unsupported network %q, expect tcp, udp or unix", r.Network)
+		}
+
+		if err := validateListen(r.Listen, network); err != "" {
+			add("listen", "%s", err)
+		} else if j, ok := listens[listenKey(r.Listen, network)]; ok && r.IsEnabled() {
+			add("listen", "%s is also used by %s", r.Listen, name(j))
+		} else if r.IsEnabled() {
+			listens[listenKey(r.Listen, network)] = i
+		}
+
+		if r.DialTimeout < 0 {
+			add("dial_timeout", "negative")
+		}
+		if r.IdleTimeout < 0 {
+			add("idle_timeout", "negative")
+		}
+		if r.Bandwidth < 0 {
+			add("bandwidth", "negative")
+		}
+
+		switch r.ProxyProtocol {
+		case "":
+		case "v1", "v2":
+			if network == NetworkUDP {
+				add("proxy_protocol", "not supported for udp")
+			}
+		default:
+			add("proxy_protocol", "unsupported %q, expect v1 or v2", r.ProxyProtocol)
+		}
+
+		if r.TLS != nil {
+			switch {
+			case network == NetworkUDP:
+				add("tls", "not supported for udp")
+			case r.TLS.Cert == "" || r.TLS.Key == "":
+				add("tls", "cert and key are required")
+			default:
+				if _, err := tls.LoadX509KeyPair(r.TLS.Cert, r.TLS.Key); err != nil {
+					add("tls", "%v", err)
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+// listenKey is the socket a rule listens on, a unix target is still
+// served on a tcp listener.
+func listenKey(listen, network string) string {
+	switch {
+	case strings.HasPrefix(listen, "unix:"):
+		return listen
+	case network == NetworkUDP:
+		return NetworkUDP + " " + listen
+	}
+	return NetworkTCP + " " + listen
+}
+
+func validateListen(listen, network string) string {
+	if listen == "" {
+		return "required"
+	}
+
+	if path, ok := strings.CutPrefix(listen, "unix:"); ok {
+		if network == NetworkUDP {
+			return "udp can't listen on a unix socket"
+		}
+		if path == "" {
+			return "unix socket without path"
+		}
+		return ""
+	}
+
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return strings.TrimPrefix(err.Error(), "address "+listen+": ")
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Sprintf("invalid port %q", port)
+	}
+	return ""
+}
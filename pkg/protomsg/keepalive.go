@@ -0,0 +1,192 @@
+package protomsg
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrKeepaliveTimeout = errors.New("keepalive timeout")
+
+type KeepaliveConfig struct {
+	// Interval between two pings
+	Interval time.Duration
+	// Timeout waits for a pong before the ping is counted as lost
+	Timeout time.Duration
+	// MaxLost consecutive lost pings close the connection
+	MaxLost int
+}
+
+var DefaultKeepalive = KeepaliveConfig{
+	Interval: time.Second * 15,
+	Timeout:  time.Second * 10,
+	MaxLost:  1,
+}
+
+// WithDefault fills unset fields from DefaultKeepalive.
+func (c KeepaliveConfig) WithDefault() KeepaliveConfig {
+	if c.Interval <= 0 {
+		c.Interval = DefaultKeepalive.Interval
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultKeepalive.Timeout
+	}
+	if c.MaxLost <= 0 {
+		c.MaxLost = DefaultKeepalive.MaxLost
+	}
+	return c
+}
+
+type KeepaliveStats struct {
+	Sent     uint64        `json:"sent"`
+	Received uint64        `json:"received"`
+	Lost     uint64        `json:"lost"`
+	RTT      time.Duration `json:"rtt"`
+	SRTT     time.Duration `json:"srtt"`
+	Jitter   time.Duration `json:"jitter"`
+	LastPong time.Time     `json:"last_pong"`
+}
+
+// Keepalive sends pings on a control connection and measures rtt, jitter
+// and loss from the pongs passed to HandlePong.
+type Keepalive struct {
+	config KeepaliveConfig
+	pong   chan uint64
+
+	mu    sync.Mutex
+	seq   uint64
+	stats KeepaliveStats
+}
+
+func NewKeepalive(config KeepaliveConfig) *Keepalive {
+	return &Keepalive{
+		config: config.WithDefault(),
+		pong:   make(chan uint64, 5),
+	}
+}
+
+func (k *Keepalive) Config() KeepaliveConfig { return k.config }
+
+func (k *Keepalive) Stats() KeepaliveStats {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.stats
+}
+
+// Run pings until closed is closed, it returns ErrKeepaliveTimeout when
+// MaxLost pings in a row are not answered.
+func (k *Keepalive) Run(w *Writer, closed <-chan struct{}) error {
+	ticker := time.NewTicker(k.config.Interval)
+	defer ticker.Stop()
+
+	lost := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-closed:
+			return nil
+		}
+
+		seq, req := k.ping()
+		if err := w.SendPriority(context.TODO(), req); err != nil {
+			return err
+		}
+
+		if k.wait(seq, closed) {
+			lost = 0
+			continue
+		}
+
+		select {
+		case <-closed:
+			return nil
+		default:
+		}
+
+		lost++
+		if lost >= k.config.MaxLost {
+			return ErrKeepaliveTimeout
+		}
+	}
+}
+
+func (k *Keepalive) wait(seq uint64, closed <-chan struct{}) bool {
+	timer := time.NewTimer(k.config.Timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case s := <-k.pong:
+			if s == seq {
+				return true
+			}
+		case <-closed:
+			return false
+		case <-timer.C:
+			k.mu.Lock()
+			k.stats.Lost++
+			k.mu.Unlock()
+			return false
+		}
+	}
+}
+
+func (k *Keepalive) ping() (uint64, *Request) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.seq++
+	k.stats.Sent++
+
+	return k.seq, &Request{
+		Type: Type_Ping,
+		Payload: &Request_Ping{Ping: &PingMsg{
+			Seq:       k.seq,
+			Timestamp: time.Now().UnixNano(),
+		}},
+	}
+}
+
+func (k *Keepalive) HandlePong(p *PongMsg) {
+	k.mu.Lock()
+	k.stats.Received++
+	k.stats.LastPong = time.Now()
+	if p.GetTimestamp() != 0 {
+		if rtt := time.Since(time.Unix(0, p.GetTimestamp())); rtt >= 0 {
+			k.updateRTT(rtt)
+		}
+	}
+	k.mu.Unlock()
+
+	select {
+	case k.pong <- p.GetSeq():
+	default:
+	}
+}
+
+func (k *Keepalive) updateRTT(rtt time.Duration) {
+	if k.stats.SRTT == 0 {
+		k.stats.SRTT = rtt
+	} else {
+		// rfc 6298 smoothed rtt and rfc 3550 interarrival jitter
+		k.stats.SRTT += (rtt - k.stats.SRTT) / 8
+		d := rtt - k.stats.RTT
+		if d < 0 {
+			d = -d
+		}
+		k.stats.Jitter += (d - k.stats.Jitter) / 16
+	}
+
+	k.stats.RTT = rtt
+}
+
+func NewPongFor(ping *PingMsg) *Request {
+	return &Request{
+		Type: Type_Pong,
+		Payload: &Request_Pong{Pong: &PongMsg{
+			Seq:       ping.GetSeq(),
+			Timestamp: ping.GetTimestamp(),
+		}},
+	}
+}
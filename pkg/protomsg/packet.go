@@ -0,0 +1,84 @@
+package protomsg
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+const NetworkUDP = "udp"
+
+// MaxPacketSize is the largest datagram a udp stream carries.
+const MaxPacketSize = 65535
+
+// WritePacket writes a datagram to a udp stream, every datagram is framed
+// with a two byte big endian length.
+func WritePacket(w io.Writer, b []byte) error {
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadPacket reads a datagram of a udp stream into buf and returns its size.
+func ReadPacket(r io.Reader, buf []byte) (int, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return 0, err
+	}
+
+	n := int(binary.BigEndian.Uint16(size[:]))
+	if n > len(buf) {
+		return 0, io.ErrShortBuffer
+	}
+	return io.ReadFull(r, buf[:n])
+}
+
+// PacketStream makes a connected udp conn look like a udp stream, reads
+// return framed datagrams and writes are split into datagrams, so it can be
+// relayed to a stream as it is.
+func PacketStream(conn net.Conn) net.Conn {
+	return &packetStream{Conn: conn, buf: make([]byte, 2+MaxPacketSize)}
+}
+
+type packetStream struct {
+	net.Conn
+	buf     []byte
+	pending []byte
+	write   []byte
+}
+
+func (p *packetStream) Read(b []byte) (int, error) {
+	if len(p.pending) == 0 {
+		n, err := p.Conn.Read(p.buf[2:])
+		if err != nil {
+			return 0, err
+		}
+		binary.BigEndian.PutUint16(p.buf, uint16(n))
+		p.pending = p.buf[:2+n]
+	}
+
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+func (p *packetStream) Write(b []byte) (int, error) {
+	p.write = append(p.write, b...)
+
+	for len(p.write) >= 2 {
+		n := int(binary.BigEndian.Uint16(p.write))
+		if len(p.write) < 2+n {
+			break
+		}
+		if _, err := p.Conn.Write(p.write[2 : 2+n]); err != nil {
+			return 0, err
+		}
+		p.write = p.write[2+n:]
+	}
+
+	// keep the partial frame at the start of the buffer
+	p.write = append(p.write[:0:0], p.write...)
+	return len(b), nil
+}
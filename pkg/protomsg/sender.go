@@ -6,15 +6,43 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 
 	"github.com/Asutorufa/yuhaiin/pkg/utils/pool"
 	"google.golang.org/protobuf/proto"
 )
 
-func SendOk(c io.Writer) error {
-	return SendRequest(c, &Request{
+const MaxMessageSize = 0xffff
+
+var ErrInvalidMessage = errors.New("invalid message")
+
+func NewOk() *Request {
+	return &Request{
 		Type:    Type_Ok,
-		Payload: &Request_Ok{Ok: &OkMsg{}},
+		Payload: &Request_Ok{Ok: &OkMsg{Hello: NewHello()}},
+	}
+}
+
+func NewPing() *Request {
+	return &Request{
+		Type:    Type_Ping,
+		Payload: &Request_Ping{Ping: &PingMsg{}},
+	}
+}
+
+func NewPong() *Request {
+	return &Request{
+		Type:    Type_Pong,
+		Payload: &Request_Pong{Pong: &PongMsg{}},
+	}
+}
+
+func SendOk(c io.Writer) error { return SendRequest(c, NewOk()) }
+
+func SendError(c io.Writer, err error) error {
+	return SendRequest(c, &Request{
+		Type:    Type_Error,
+		Payload: &Request_Error{Error: &ErrorMsg{Msg: err.Error()}},
 	})
 }
 
@@ -27,6 +55,10 @@ func SendRequest(c io.Writer, req *Request) error {
 		return err
 	}
 
+	if len(data) == 0 || len(data) > MaxMessageSize {
+		return fmt.Errorf("%w: length %d", ErrInvalidMessage, len(data))
+	}
+
 	_ = binary.Write(buf, binary.BigEndian, uint64(len(data)))
 	_, _ = buf.Write(data)
 
@@ -38,47 +70,83 @@ func SendRequest(c io.Writer, req *Request) error {
 	return nil
 }
 
-func SendPing(c io.Writer) error {
-	return SendRequest(c, &Request{
-		Type:    Type_Ping,
-		Payload: &Request_Ping{Ping: &PingMsg{}},
-	})
+func SendPing(c io.Writer) error { return SendRequest(c, NewPing()) }
+func SendPong(c io.Writer) error { return SendRequest(c, NewPong()) }
+
+func NewConnect(device, address string, port uint16) *Request {
+	return &Request{
+		Type: Type_Connection,
+		Payload: &Request_Connect{
+			Connect: &Connect{
+				Target:  device,
+				Address: address,
+				Port:    uint32(port),
+				Hello:   NewHello(),
+			},
+		},
+	}
 }
 
-func SendPong(c io.Writer) error {
-	return SendRequest(c, &Request{
-		Type:    Type_Pong,
-		Payload: &Request_Pong{Pong: &PongMsg{}},
-	})
+// HostPort returns the address and port of the target on the device, or
+// unix: and the socket name. Udp targets are prefixed with udp:.
+func (x *Connect) HostPort() string {
+	switch x.GetNetwork() {
+	case NetworkUnix:
+		return NetworkUnix + ":" + x.GetAddress()
+	case NetworkUDP:
+		return NetworkUDP + ":" + net.JoinHostPort(x.GetAddress(), strconv.Itoa(int(x.GetPort())))
+	}
+	return net.JoinHostPort(x.GetAddress(), strconv.Itoa(int(x.GetPort())))
 }
 
-func SendRegister(conn net.Conn, uuid string) error {
+const NetworkUnix = "unix"
+
+// NewUnixConnect asks a device for the unix socket it exposes as name.
+func NewUnixConnect(device, name string) *Request {
+	req := NewConnect(device, name, 0)
+	req.GetConnect().Network = NetworkUnix
+	return req
+}
+
+func SendRegister(conn net.Conn, device *Device) error {
+	_, err := Register(conn, device)
+	return err
+}
+
+// Register sends the registration of device and returns the hello of the
+// server.
+func Register(conn net.Conn, device *Device) (*Hello, error) {
 	err := SendRequest(conn, &Request{
-		Type: Type_Register,
-		Payload: &Request_Device{
-			Device: &Device{
-				Uuid: uuid,
-			},
-		},
+		Type:    Type_Register,
+		Payload: &Request_Device{Device: device},
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	resp, err := GetRequestReader(conn)
+	return ReadOk(conn)
+}
+
+// ReadOk reads an Ok and returns the hello in it, an old server sends an
+// empty one.
+func ReadOk(c io.Reader) (*Hello, error) {
+	resp, err := GetRequestReader(c)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if resp.Type == Type_Error {
-		return errors.New(resp.GetError().GetMsg())
+		return nil, errors.New(resp.GetError().GetMsg())
 	}
 
 	if resp.Type != Type_Ok {
-		return fmt.Errorf("unknown type: %d", resp.Type)
+		return nil, fmt.Errorf("unknown type: %d", resp.Type)
 	}
 
-	return nil
+	if hello := resp.GetOk().GetHello(); hello != nil {
+		return hello, nil
+	}
+	return &Hello{}, nil
 }
 
 func GetRequest(data []byte) (*Request, error) {
@@ -92,25 +160,43 @@ func GetRequest(data []byte) (*Request, error) {
 }
 
 func GetRequestReader(c io.Reader) (*Request, error) {
-	var length uint64
-	if err := binary.Read(c, binary.BigEndian, &length); err != nil {
+	var header [8]byte
+	if _, err := io.ReadFull(c, header[:]); err != nil {
 		return nil, err
 	}
 
-	if length <= 0 || length > 0xffff {
-		return nil, fmt.Errorf("invalid length: %d", length)
+	length := binary.BigEndian.Uint64(header[:])
+	if length == 0 || length > MaxMessageSize {
+		return nil, fmt.Errorf("%w: length %d", ErrInvalidMessage, length)
 	}
 
-	data := make([]byte, length)
-	if _, err := io.ReadFull(c, data); err != nil {
+	data := pool.GetBytes(int(length))
+	defer pool.PutBytes(data)
+
+	if _, err := io.ReadFull(c, data[:length]); err != nil {
 		return nil, err
 	}
 
-	return GetRequest(data)
+	return GetRequest(data[:length])
 }
 
 type Target struct {
 	UUID    string `json:"uuid"`
 	Address string `json:"address"`
 	Port    uint16 `json:"port"`
+	// Network is tcp when empty, unix opens the socket the device exposes
+	// as Address
+	Network string `json:"network,omitempty"`
+}
+
+// NewConnect asks the device of the target for a stream to it.
+func (t Target) NewConnect() *Request {
+	if t.Network == NetworkUnix {
+		return NewUnixConnect(t.UUID, t.Address)
+	}
+	req := NewConnect(t.UUID, t.Address, t.Port)
+	if t.Network == NetworkUDP {
+		req.GetConnect().Network = NetworkUDP
+	}
+	return req
 }
@@ -0,0 +1,75 @@
+package protomsg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func encode(t testing.TB, req *Request) []byte {
+	buf := &bytes.Buffer{}
+	if err := SendRequest(buf, req); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func FuzzGetRequestReader(f *testing.F) {
+	f.Add(encode(f, NewConnect("dev1", "127.0.0.1", 22)))
+	f.Add(encode(f, &Request{Type: Type_Register, Payload: &Request_Device{Device: &Device{Uuid: "dev1"}}}))
+	f.Add(encode(f, &Request{Type: Type_Ping, Payload: &Request_Ping{Ping: &PingMsg{}}}))
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0, 0})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		req, err := GetRequestReader(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		// a decoded message must survive a round trip
+		again, err := GetRequestReader(bytes.NewReader(encode(t, req)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(req, again) {
+			t.Fatalf("round trip mismatch: %v != %v", req, again)
+		}
+	})
+}
+
+func TestGetRequestReaderInvalid(t *testing.T) {
+	valid := encode(t, NewConnect("dev1", "127.0.0.1", 22))
+
+	header := func(length uint64) []byte {
+		return binary.BigEndian.AppendUint64(nil, length)
+	}
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"empty", nil, io.EOF},
+		{"short header", []byte{0, 0, 0}, io.ErrUnexpectedEOF},
+		{"zero length", header(0), ErrInvalidMessage},
+		{"too long", header(MaxMessageSize + 1), ErrInvalidMessage},
+		{"max uint64", header(^uint64(0)), ErrInvalidMessage},
+		{"truncated body", valid[:len(valid)-1], io.ErrUnexpectedEOF},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := GetRequestReader(bytes.NewReader(tt.data))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expect %v, got %v", tt.err, err)
+			}
+		})
+	}
+
+	if _, err := GetRequestReader(bytes.NewReader(append(header(3), 0xff, 0xff, 0xff))); err == nil {
+		t.Fatal("expect unmarshal error")
+	}
+}
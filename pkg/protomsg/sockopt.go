@@ -0,0 +1,31 @@
+package protomsg
+
+import (
+	"net"
+	"time"
+)
+
+// SetKeepaliveSockopt enables tcp keepalive on a control connection and, on
+// linux, bounds unacknowledged data with TCP_USER_TIMEOUT so a dead peer is
+// noticed even while writes are pending. A tls connection is set on its tcp
+// connection.
+func SetKeepaliveSockopt(conn net.Conn, config KeepaliveConfig) {
+	if tc, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = tc.NetConn()
+	}
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	config = config.WithDefault()
+
+	_ = tc.SetKeepAliveConfig(net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     config.Interval,
+		Interval: config.Interval,
+		Count:    3,
+	})
+
+	setUserTimeout(tc, config.Interval+config.Timeout*time.Duration(config.MaxLost))
+}
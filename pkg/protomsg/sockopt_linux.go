@@ -0,0 +1,23 @@
+package protomsg
+
+import (
+	"log/slog"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func setUserTimeout(tc *net.TCPConn, timeout time.Duration) {
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	_ = rc.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(timeout.Milliseconds()))
+	})
+	if err != nil {
+		slog.Warn("set tcp user timeout failed", "err", err)
+	}
+}
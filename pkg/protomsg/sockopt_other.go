@@ -0,0 +1,10 @@
+//go:build !linux
+
+package protomsg
+
+import (
+	"net"
+	"time"
+)
+
+func setUserTimeout(*net.TCPConn, time.Duration) {}
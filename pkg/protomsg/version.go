@@ -0,0 +1,108 @@
+package protomsg
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Asutorufa/tunnel/internal/version"
+)
+
+const (
+	// ProtocolVersion is the protocol this build speaks, raise it when an
+	// old peer can't understand the messages anymore
+	ProtocolVersion = 1
+	// MinProtocolVersion is the oldest protocol this build still speaks,
+	// 0 are the peers from before versioning
+	MinProtocolVersion = 0
+)
+
+// minProtocol is the floor CheckHello enforces, tests raise it above
+// MinProtocolVersion.
+var minProtocol uint32 = MinProtocolVersion
+
+// Features are optional parts of the protocol a peer supports, a new
+// feature gets the next bit and is only used when the peer has it.
+type Features uint64
+
+const (
+	FeatureUnix Features = 1 << iota
+	FeatureUDP
+	FeatureExit
+)
+
+// SupportedFeatures are the features of this build.
+const SupportedFeatures = FeatureUnix | FeatureUDP | FeatureExit
+
+var featureNames = []string{"unix", "udp", "exit"}
+
+func (f Features) Has(x Features) bool { return f&x == x }
+
+func (f Features) String() string {
+	var names []string
+	for i, name := range featureNames {
+		if f.Has(1 << i) {
+			names = append(names, name)
+		}
+	}
+	if unknown := f &^ (1<<len(featureNames) - 1); unknown != 0 {
+		names = append(names, fmt.Sprintf("%#x", uint64(unknown)))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// NewHello is the hello of this build.
+func NewHello() *Hello {
+	return &Hello{
+		Protocol:    ProtocolVersion,
+		MinProtocol: minProtocol,
+		Features:    uint64(SupportedFeatures),
+		Version:     version.Version,
+	}
+}
+
+func (x *Hello) FeatureSet() Features { return Features(x.GetFeatures()) }
+
+func (x *Hello) describe() string {
+	if x.GetVersion() == "" {
+		return fmt.Sprintf("protocol %d", x.GetProtocol())
+	}
+	return fmt.Sprintf("%s, protocol %d", x.GetVersion(), x.GetProtocol())
+}
+
+var (
+	ErrProtocol    = errors.New("protocol version mismatch")
+	ErrUnsupported = errors.New("feature not supported")
+)
+
+// CheckHello returns an error naming the side to upgrade when this build,
+// self like "server", can't speak with peer, like "device dev1".
+func CheckHello(self, peer string, h *Hello) error {
+	if h.GetProtocol() < minProtocol {
+		return fmt.Errorf("%w: %s (%s) is too old for %s (%s) which needs protocol %d or newer, upgrade %s",
+			ErrProtocol, peer, h.describe(), self, NewHello().describe(), minProtocol, peer)
+	}
+	if h.GetMinProtocol() > ProtocolVersion {
+		return fmt.Errorf("%w: %s (%s) needs protocol %d or newer, %s (%s) is too old, upgrade %s",
+			ErrProtocol, peer, h.describe(), h.GetMinProtocol(), self, NewHello().describe(), self)
+	}
+	return nil
+}
+
+// Needs returns the features a device must have to serve the connect.
+func (x *Connect) Needs() Features {
+	var f Features
+	switch x.GetNetwork() {
+	case NetworkUnix:
+		f |= FeatureUnix
+	case NetworkUDP:
+		f |= FeatureUDP
+	}
+	if x.GetExit() {
+		f |= FeatureExit
+	}
+	return f
+}
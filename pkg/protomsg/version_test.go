@@ -0,0 +1,46 @@
+package protomsg
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFeatures(t *testing.T) {
+	for f, want := range map[Features]string{
+		0:                         "none",
+		FeatureUDP:                "udp",
+		FeatureUnix | FeatureExit: "unix,exit",
+		FeatureUDP | 1<<10:        "udp,0x400",
+	} {
+		if got := f.String(); got != want {
+			t.Errorf("%d: expect %s, got %s", uint64(f), want, got)
+		}
+	}
+}
+
+func TestCheckHello(t *testing.T) {
+	if err := CheckHello("server", "device dev1", nil); err != nil {
+		t.Errorf("expect a peer from before versioning accepted, got %v", err)
+	}
+	if err := CheckHello("server", "device dev1", NewHello()); err != nil {
+		t.Error(err)
+	}
+
+	err := CheckHello("server", "device dev1", &Hello{Protocol: ProtocolVersion + 1, MinProtocol: ProtocolVersion + 1})
+	if !errors.Is(err, ErrProtocol) {
+		t.Errorf("expect a peer of a newer protocol refused, got %v", err)
+	} else if !strings.Contains(err.Error(), "upgrade server") {
+		t.Errorf("expect the server asked to upgrade, got %v", err)
+	}
+
+	defer func(floor uint32) { minProtocol = floor }(minProtocol)
+	minProtocol = 2
+	err = CheckHello("server", "device dev1", &Hello{Protocol: 1, Version: "v0.1.0"})
+	if !errors.Is(err, ErrProtocol) {
+		t.Errorf("expect a peer older than the min protocol refused, got %v", err)
+	} else if !strings.Contains(err.Error(), "device dev1 (v0.1.0, protocol 1) is too old") ||
+		!strings.Contains(err.Error(), "upgrade device dev1") {
+		t.Errorf("expect the device asked to upgrade, got %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package protomsg
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrWriterClosed = errors.New("control writer closed")
+
+type frame struct {
+	req  *Request
+	done chan error
+}
+
+// Writer owns all writes to a control connection. Messages are written by a
+// single goroutine, keepalives sent with SendPriority jump ahead of queued
+// connect requests, and a full queue blocks senders.
+type Writer struct {
+	conn    net.Conn
+	timeout time.Duration
+
+	high   chan frame
+	normal chan frame
+
+	closed chan struct{}
+	once   sync.Once
+	err    error
+}
+
+func NewWriter(conn net.Conn, queueSize int, timeout time.Duration) *Writer {
+	w := &Writer{
+		conn:    conn,
+		timeout: timeout,
+		high:    make(chan frame, 4),
+		normal:  make(chan frame, queueSize),
+		closed:  make(chan struct{}),
+	}
+
+	go w.loop()
+
+	return w
+}
+
+func (w *Writer) Send(ctx context.Context, req *Request) error {
+	return w.send(ctx, w.normal, req)
+}
+
+func (w *Writer) SendPriority(ctx context.Context, req *Request) error {
+	return w.send(ctx, w.high, req)
+}
+
+func (w *Writer) send(ctx context.Context, queue chan frame, req *Request) error {
+	f := frame{req: req, done: make(chan error, 1)}
+
+	select {
+	case queue <- f:
+	case <-w.closed:
+		return w.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-f.done:
+		return err
+	case <-w.closed:
+		return w.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *Writer) loop() {
+	for {
+		var f frame
+
+		select {
+		case f = <-w.high:
+		default:
+			select {
+			case f = <-w.high:
+			case f = <-w.normal:
+			case <-w.closed:
+				return
+			}
+		}
+
+		if w.timeout > 0 {
+			_ = w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+		}
+
+		err := SendRequest(w.conn, f.req)
+		f.done <- err
+		if err != nil {
+			w.closeWithError(err)
+			_ = w.conn.Close()
+			return
+		}
+	}
+}
+
+func (w *Writer) closeWithError(err error) {
+	w.once.Do(func() {
+		w.err = err
+		close(w.closed)
+	})
+}
+
+// Close stops the writer, it does not close the underlying connection.
+func (w *Writer) Close() error {
+	w.closeWithError(ErrWriterClosed)
+	return nil
+}
@@ -0,0 +1,113 @@
+package protomsg
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// gateConn holds every write until release is closed, writing tells
+// which writes are in flight.
+type gateConn struct {
+	net.Conn
+	writing chan struct{}
+	release chan struct{}
+}
+
+func newGateConn(c net.Conn) *gateConn {
+	return &gateConn{Conn: c, writing: make(chan struct{}, 16), release: make(chan struct{})}
+}
+
+func (c *gateConn) Write(b []byte) (int, error) {
+	c.writing <- struct{}{}
+	<-c.release
+	return c.Conn.Write(b)
+}
+
+// waitQueued waits for the frames sent to w to reach its queues.
+func waitQueued(w *Writer, normal, high int) {
+	for len(w.normal) < normal || len(w.high) < high {
+		runtime.Gosched()
+	}
+}
+
+func TestWriterPriority(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	conn := newGateConn(server)
+	w := NewWriter(conn, 16, time.Second*5)
+	defer w.Close()
+
+	errs := make(chan error, 8)
+	go func() { errs <- w.Send(context.Background(), NewConnect("dev", "", 1)) }()
+	<-conn.writing
+
+	for i := range 3 {
+		go func() { errs <- w.Send(context.Background(), NewConnect("dev", "", uint16(i+2))) }()
+	}
+	go func() { errs <- w.SendPriority(context.Background(), NewPing()) }()
+	waitQueued(w, 3, 1)
+	close(conn.release)
+
+	var types []Type
+	for range 5 {
+		req, err := GetRequestReader(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, req.GetType())
+	}
+
+	for range 5 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if types[1] != Type_Ping {
+		t.Fatalf("ping should be written right after the in-flight connect, got %v", types)
+	}
+}
+
+func TestWriterBackpressure(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	conn := newGateConn(server)
+	defer close(conn.release)
+	w := NewWriter(conn, 1, time.Minute)
+	defer w.Close()
+
+	// one in flight, one queued
+	go func() { _ = w.Send(context.Background(), NewPing()) }()
+	<-conn.writing
+	go func() { _ = w.Send(context.Background(), NewPing()) }()
+	waitQueued(w, 1, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := w.Send(ctx, NewConnect("dev", "", 22)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect canceled, got %v", err)
+	}
+}
+
+func TestWriterDeadline(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	w := NewWriter(server, 16, time.Millisecond*100)
+
+	if err := w.Send(context.Background(), NewPing()); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+
+	if err := w.Send(context.Background(), NewPing()); err == nil {
+		t.Fatal("writer should be closed after a failed write")
+	}
+}
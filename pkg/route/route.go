@@ -0,0 +1,222 @@
+// Package route decides whether a destination goes through the tunnel, is
+// dialed directly, goes to an upstream proxy or is rejected.
+package route
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type Action string
+
+const (
+	Tunnel Action = "tunnel"
+	Direct Action = "direct"
+	Proxy  Action = "proxy"
+	Reject Action = "reject"
+)
+
+func (a Action) valid() bool {
+	switch a {
+	case Tunnel, Direct, Proxy, Reject:
+		return true
+	}
+	return false
+}
+
+// Rule matches when all of its set conditions match.
+type Rule struct {
+	// Suffix matches a domain and all of its subdomains
+	Suffix string `json:"suffix,omitempty"`
+	// CIDR matches ip literal destinations, names are not resolved
+	CIDR string `json:"cidr,omitempty"`
+	// Port is a comma separated list of ports and ranges, "80,8000-8100"
+	Port   string `json:"port,omitempty"`
+	Action Action `json:"action"`
+	// Via names the proxy of a proxy rule for users with several proxies
+	Via string `json:"via,omitempty"`
+
+	prefix netip.Prefix
+	ports  []portRange
+}
+
+type portRange struct{ from, to uint16 }
+
+// Table is an ordered rule list, the first matching rule wins:
+//
+//	{
+//	  "rules": [
+//	    {"suffix": "tunnel", "action": "tunnel"},
+//	    {"cidr": "10.0.0.0/8", "action": "direct"},
+//	    {"port": "25", "action": "reject"}
+//	  ],
+//	  "default": "proxy"
+//	}
+type Table struct {
+	Rules []Rule `json:"rules"`
+	// Default is the action when no rule matches, direct if it is empty
+	Default Action `json:"default,omitempty"`
+}
+
+func Load(path string) (*Table, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return t, nil
+}
+
+func Parse(data []byte) (*Table, error) {
+	t := &Table{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, err
+	}
+	if err := t.Compile(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Compile validates the rules, it has to be called before Match for a
+// table that is not from Parse.
+func (t *Table) Compile() error {
+	if t.Default == "" {
+		t.Default = Direct
+	}
+	if !t.Default.valid() {
+		return fmt.Errorf("invalid default action %q", t.Default)
+	}
+
+	for i := range t.Rules {
+		if err := t.Rules[i].compile(); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) compile() error {
+	if !r.Action.valid() {
+		return fmt.Errorf("invalid action %q", r.Action)
+	}
+	if r.Via != "" && r.Action != Proxy {
+		return fmt.Errorf("via %q on a %s rule", r.Via, r.Action)
+	}
+	if r.Suffix == "" && r.CIDR == "" && r.Port == "" {
+		return fmt.Errorf("rule without suffix, cidr or port")
+	}
+
+	r.Suffix = strings.ToLower(strings.Trim(r.Suffix, "."))
+
+	if r.CIDR != "" {
+		prefix, err := parsePrefix(r.CIDR)
+		if err != nil {
+			return err
+		}
+		r.prefix = prefix
+	}
+
+	if r.Port != "" {
+		ports, err := parsePorts(r.Port)
+		if err != nil {
+			return err
+		}
+		r.ports = ports
+	}
+
+	return nil
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
+
+func parsePorts(s string) ([]portRange, error) {
+	var ports []portRange
+	for _, r := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(strings.TrimSpace(r), "-")
+		if !isRange {
+			to = from
+		}
+
+		f, err := strconv.ParseUint(from, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q: %w", r, err)
+		}
+		t, err := strconv.ParseUint(to, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q: %w", r, err)
+		}
+		if f > t {
+			return nil, fmt.Errorf("invalid port range %q", r)
+		}
+
+		ports = append(ports, portRange{uint16(f), uint16(t)})
+	}
+	return ports, nil
+}
+
+// Match returns the action for host, a domain or an ip literal, and port.
+func (t *Table) Match(host string, port uint16) Action {
+	action, _ := t.Lookup(host, port)
+	return action
+}
+
+// Lookup is Match that also returns the via of the matching rule.
+func (t *Table) Lookup(host string, port uint16) (Action, string) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	addr, _ := netip.ParseAddr(strings.Trim(host, "[]"))
+
+	for _, r := range t.Rules {
+		if r.match(host, addr.Unmap(), port) {
+			return r.Action, r.Via
+		}
+	}
+	return t.Default, ""
+}
+
+func (r *Rule) match(host string, addr netip.Addr, port uint16) bool {
+	if r.Suffix != "" && host != r.Suffix && !strings.HasSuffix(host, "."+r.Suffix) {
+		return false
+	}
+
+	if r.prefix.IsValid() && (!addr.IsValid() || !r.prefix.Contains(addr)) {
+		return false
+	}
+
+	if len(r.ports) > 0 {
+		ok := false
+		for _, p := range r.ports {
+			if port >= p.from && port <= p.to {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
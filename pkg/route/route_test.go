@@ -0,0 +1,83 @@
+package route
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	table, err := Parse([]byte(`{
+		"rules": [
+			{"suffix": "tunnel", "action": "tunnel"},
+			{"suffix": "corp.example.com", "port": "443", "action": "proxy"},
+			{"cidr": "10.0.0.0/8", "action": "direct"},
+			{"cidr": "fd00::/8", "action": "reject"},
+			{"port": "25,6660-6669", "action": "reject"}
+		],
+		"default": "proxy"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		host string
+		port uint16
+		want Action
+	}{
+		{"dev1.tunnel", 22, Tunnel},
+		{"db.dev1.TUNNEL.", 5432, Tunnel},
+		{"tunnel", 22, Tunnel},
+		{"mytunnel", 22, Proxy},
+		{"git.corp.example.com", 443, Proxy},
+		{"git.corp.example.com", 22, Proxy},
+		{"10.1.2.3", 80, Direct},
+		{"::ffff:10.1.2.3", 80, Direct},
+		{"[fd00::1]", 80, Reject},
+		{"example.com", 25, Reject},
+		{"example.com", 6667, Reject},
+		{"example.com", 443, Proxy},
+	} {
+		if got := table.Match(tt.host, tt.port); got != tt.want {
+			t.Errorf("%s:%d expect %s, got %s", tt.host, tt.port, tt.want, got)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, data := range []string{
+		`{"default": "drop"}`,
+		`{"rules": [{"suffix": "a", "action": "drop"}]}`,
+		`{"rules": [{"action": "direct"}]}`,
+		`{"rules": [{"cidr": "10.0.0.0/33", "action": "direct"}]}`,
+		`{"rules": [{"port": "80-70", "action": "direct"}]}`,
+		`{"rules": [{"port": "80", "action": "direct", "via": "jump"}]}`,
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("expect error for %s", data)
+		}
+	}
+}
+
+func TestLookupVia(t *testing.T) {
+	table, err := Parse([]byte(`{
+		"rules": [
+			{"cidr": "10.2.0.0/16", "action": "proxy", "via": "jump"},
+			{"suffix": "internal", "action": "proxy"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		host   string
+		action Action
+		via    string
+	}{
+		{"10.2.3.4", Proxy, "jump"},
+		{"git.internal", Proxy, ""},
+		{"example.com", Direct, ""},
+	} {
+		if action, via := table.Lookup(tt.host, 80); action != tt.action || via != tt.via {
+			t.Errorf("%s expect %s via %q, got %s via %q", tt.host, tt.action, tt.via, action, via)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package tunnelserver
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+type EventType int
+
+const (
+	EventRegistered EventType = iota + 1
+	// EventReplaced is emitted for the old session when the same uuid registers again
+	EventReplaced
+	// EventKeepaliveTimeout and EventDisconnected are emitted when the
+	// current session of a device goes away
+	EventKeepaliveTimeout
+	EventDisconnected
+	EventStreamOpen
+	EventStreamClose
+	// EventRouteConflict is emitted when a device advertises a prefix that
+	// another device already owns, Target is the prefix
+	EventRouteConflict
+)
+
+var eventTypeNames = map[EventType]string{
+	EventRegistered:       "registered",
+	EventReplaced:         "replaced",
+	EventKeepaliveTimeout: "keepalive-timeout",
+	EventDisconnected:     "disconnected",
+	EventStreamOpen:       "stream-open",
+	EventStreamClose:      "stream-close",
+	EventRouteConflict:    "route-conflict",
+}
+
+func (e EventType) String() string {
+	if name, ok := eventTypeNames[e]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+func (e EventType) MarshalText() ([]byte, error) { return []byte(e.String()), nil }
+
+func (e *EventType) UnmarshalText(b []byte) error {
+	for t, name := range eventTypeNames {
+		if name == string(b) {
+			*e = t
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown event type: %s", b)
+}
+
+type Event struct {
+	Type       EventType `json:"type"`
+	UUID       string    `json:"uuid"`
+	Generation uint64    `json:"generation,omitempty"`
+	Remote     string    `json:"remote,omitempty"`
+	Time       time.Time `json:"time"`
+	StreamID   uint64    `json:"stream_id,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Subscribe returns a channel receiving device and stream events, events are
+// dropped when the subscriber can't keep up. The returned func unsubscribes.
+func (s *Server) Subscribe() (<-chan Event, func()) {
+	return s.events.subscribe()
+}
+
+type broker struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func (b *broker) subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 64)
+
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = make(map[chan Event]struct{})
+	}
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (b *broker) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			slog.Warn("drop event, subscriber is too slow", "type", e.Type, "uuid", e.UUID)
+		}
+	}
+}
+
+// streamConn publishes EventStreamClose when the stream is closed.
+type streamConn struct {
+	net.Conn
+	once    sync.Once
+	onClose func()
+}
+
+func (s *streamConn) Close() error {
+	s.once.Do(s.onClose)
+	return s.Conn.Close()
+}
+
+func (s *streamConn) CloseWrite() error {
+	if cw, ok := s.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return s.Close()
+}
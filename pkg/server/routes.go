@@ -0,0 +1,87 @@
+package tunnelserver
+
+import (
+	"cmp"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/Asutorufa/tunnel/pkg/protomsg"
+)
+
+// Route is a prefix advertised by a device, the device reaches addresses in
+// it for requesters that connect to a plain ip.
+type Route struct {
+	Prefix netip.Prefix `json:"prefix"`
+	UUID   string       `json:"uuid"`
+}
+
+func parseRoutes(device *protomsg.Device) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, r := range device.GetRoutes() {
+		prefix, err := netip.ParsePrefix(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid route %q: %w", protomsg.ErrInvalidMessage, r, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// claims are the devices advertising each prefix in the order they first
+// advertised it, a device keeps its place across reconnects.
+type claims map[netip.Prefix][]string
+
+// claim records the prefixes of a registration of uuid, prefixes it no
+// longer advertises lose its place.
+func (c claims) claim(uuid string, prefixes []netip.Prefix) {
+	for prefix, uuids := range c {
+		if !slices.Contains(prefixes, prefix) {
+			if uuids = slices.DeleteFunc(uuids, func(u string) bool { return u == uuid }); len(uuids) == 0 {
+				delete(c, prefix)
+			} else {
+				c[prefix] = uuids
+			}
+		}
+	}
+	for _, prefix := range prefixes {
+		if !slices.Contains(c[prefix], uuid) {
+			c[prefix] = append(c[prefix], uuid)
+		}
+	}
+}
+
+// buildRoutes gives each prefix to the online device that advertised it
+// first. The table is sorted longest prefix first.
+func buildRoutes(sessions []*Session, c claims) []Route {
+	online := make(map[string]*Session, len(sessions))
+	for _, session := range sessions {
+		online[session.UUID] = session
+	}
+
+	var routes []Route
+	for prefix, uuids := range c {
+		for _, uuid := range uuids {
+			if session, ok := online[uuid]; ok && slices.Contains(session.Routes, prefix) {
+				routes = append(routes, Route{Prefix: prefix, UUID: uuid})
+				break
+			}
+		}
+	}
+
+	slices.SortFunc(routes, func(a, b Route) int {
+		return cmp.Or(cmp.Compare(b.Prefix.Bits(), a.Prefix.Bits()), a.Prefix.Addr().Compare(b.Prefix.Addr()))
+	})
+
+	return routes
+}
+
+func lookupRoute(routes []Route, addr netip.Addr) (string, bool) {
+	addr = addr.Unmap()
+	for _, r := range routes {
+		if r.Prefix.Contains(addr) {
+			return r.UUID, true
+		}
+	}
+	return "", false
+}
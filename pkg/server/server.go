@@ -1,53 +1,177 @@
 package tunnelserver
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
-	"sync"
+	"net/netip"
 	"sync/atomic"
 	"time"
 
+	"github.com/Asutorufa/tunnel/pkg/accesslog"
 	"github.com/Asutorufa/tunnel/pkg/protomsg"
 	"github.com/Asutorufa/yuhaiin/pkg/utils/relay"
 	"github.com/Asutorufa/yuhaiin/pkg/utils/syncmap"
 )
 
 type Server struct {
+	// HandshakeTimeout bounds how long a new connection may take to send its first message
+	HandshakeTimeout time.Duration
+	// Keepalive is used for devices that don't ask for their own interval and timeout
+	Keepalive protomsg.KeepaliveConfig
+	// AccessLog records the streams requested by remote requesters
+	AccessLog accesslog.Logger
+
 	devices *Devices
+	events  *broker
 	*Chan
 }
 
 func NewServer() *Server {
+	events := &broker{}
 	return &Server{
-		devices: &Devices{},
-		Chan:    &Chan{},
+		events:           events,
+		HandshakeTimeout: time.Second * 30,
+		Keepalive:        protomsg.DefaultKeepalive,
+		devices:          &Devices{events: events},
+		Chan:             &Chan{},
+	}
+}
+
+func (s *Server) Serve(lis net.Listener) error {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			if err := s.Handle(conn); err != nil {
+				slog.Error("handle failed", "err", err)
+				conn.Close()
+			}
+		}()
+	}
+}
+
+func (s *Server) Online(uuid string) bool {
+	_, ok := s.devices.devices.Load(uuid)
+	return ok
+}
+
+func (s *Server) Stats(uuid string) (protomsg.KeepaliveStats, bool) {
+	session, ok := s.devices.devices.Load(uuid)
+	if !ok {
+		return protomsg.KeepaliveStats{}, false
+	}
+	return session.Stats(), true
+}
+
+// Routes returns the prefixes advertised by online devices, longest prefix
+// first. A prefix advertised by several devices belongs to the one that
+// advertised it first, a reconnect doesn't give it away.
+func (s *Server) Routes() []Route { return s.devices.Routes() }
+
+// route picks the device for a connect without target by the advertised
+// prefix matching its address. Advertised prefixes also take exit traffic
+// away from the exit node.
+func (s *Server) route(connect *protomsg.Connect) error {
+	if connect == nil || (connect.GetTarget() != "" && !connect.GetExit()) {
+		return nil
+	}
+
+	addr, err := netip.ParseAddr(connect.GetAddress())
+	if err != nil {
+		if connect.GetTarget() != "" {
+			return nil
+		}
+		return fmt.Errorf("connect without device needs an ip address, got %q", connect.GetAddress())
+	}
+
+	uuid, ok := s.devices.Lookup(addr)
+	if !ok {
+		if connect.GetTarget() != "" {
+			return nil
+		}
+		return fmt.Errorf("no route to %s", addr)
 	}
+	connect.Target = uuid
+	connect.Exit = false
+	return nil
+}
+
+const minKeepalive = time.Second
+
+func (s *Server) keepaliveFor(device *protomsg.Device) protomsg.KeepaliveConfig {
+	config := s.Keepalive.WithDefault()
+
+	if interval := time.Duration(device.GetKeepaliveInterval()) * time.Millisecond; interval > 0 {
+		config.Interval = max(interval, minKeepalive)
+	}
+	if timeout := time.Duration(device.GetKeepaliveTimeout()) * time.Millisecond; timeout > 0 {
+		config.Timeout = max(timeout, minKeepalive)
+	}
+
+	return config
 }
 
 func (s *Server) Handle(c net.Conn) error {
+	_ = c.SetReadDeadline(time.Now().Add(s.HandshakeTimeout))
 	req, err := protomsg.GetRequestReader(c)
 	if err != nil {
 		return err
 	}
+	_ = c.SetReadDeadline(time.Time{})
 
 	slog.Debug("new request", "type", req.GetType(), "remoteAddr", c.RemoteAddr())
 
 	switch req.GetType() {
 	case protomsg.Type_Register:
-		return s.devices.RegisterDevice(req.GetDevice().Uuid, c)
+		keepalive := s.keepaliveFor(req.GetDevice())
+		protomsg.SetKeepaliveSockopt(c, keepalive)
+		return s.devices.RegisterDevice(req.GetDevice(), c, keepalive)
 	case protomsg.Type_Connection:
 		defer c.Close()
-		remote, err := s.OpenStream(context.TODO(), req)
+		ctx := accesslog.WithSource(context.TODO(), accesslog.Source{
+			Frontend: "tunnel",
+			Addr:     c.RemoteAddr().String(),
+		})
+		// resolve routed connects before logging, OpenStream reports the failure
+		_ = s.route(req.GetConnect())
+		entry := accesslog.Begin(ctx, s.AccessLog, req.GetConnect().GetTarget(), req.GetConnect().HostPort())
+		err := protomsg.CheckHello("server", "requester", req.GetConnect().GetHello())
+		var remote net.Conn
+		if err == nil {
+			remote, err = s.OpenStream(ctx, req)
+		}
 		if err != nil {
+			entry.Fail(err)
+			if req.GetConnect().GetAck() {
+				_ = protomsg.SendError(c, err)
+			}
 			return err
 		}
+		remote = entry.WrapTarget(remote)
 		defer remote.Close()
+		if req.GetConnect().GetAck() {
+			if err := protomsg.SendOk(c); err != nil {
+				return err
+			}
+		}
 		relay.Relay(remote, c)
 		return nil
 	case protomsg.Type_Response:
-		s.SendChan(req.GetConnectResponse().Connid, c)
+		if req.GetConnectResponse() == nil {
+			return fmt.Errorf("%w: response without payload", protomsg.ErrInvalidMessage)
+		}
+		var err error
+		if msg := req.GetConnectResponse().GetError(); msg != "" {
+			err = errors.New(msg)
+		}
+		s.SendChan(req.GetConnectResponse().GetConnid(), c, err)
 		return nil
 	}
 
@@ -55,9 +179,26 @@ func (s *Server) Handle(c net.Conn) error {
 }
 
 func (s *Server) OpenStream(ctx context.Context, req *protomsg.Request) (net.Conn, error) {
-	device, ok := s.devices.devices.Load(req.GetConnect().Target)
+	if req.GetConnect() == nil {
+		return nil, fmt.Errorf("%w: connection without payload", protomsg.ErrInvalidMessage)
+	}
+
+	if err := s.route(req.GetConnect()); err != nil {
+		return nil, err
+	}
+
+	device, ok := s.devices.devices.Load(req.GetConnect().GetTarget())
 	if !ok {
-		return nil, fmt.Errorf("device %s is not exist", req.GetConnect().Target)
+		return nil, fmt.Errorf("device %s is not exist", req.GetConnect().GetTarget())
+	}
+
+	if req.GetConnect().GetExit() && !device.ExitNode {
+		return nil, fmt.Errorf("device %s is not an exit node", device.UUID)
+	}
+
+	if missing := req.GetConnect().Needs() &^ device.Features(); missing != 0 {
+		return nil, fmt.Errorf("%w: device %s (%s) does not support %s, upgrade the device",
+			protomsg.ErrUnsupported, device.UUID, cmp.Or(device.Hello.GetVersion(), "unknown version"), missing)
 	}
 
 	id, ch := s.NewChan()
@@ -67,14 +208,18 @@ func (s *Server) OpenStream(ctx context.Context, req *protomsg.Request) (net.Con
 
 	slog.Debug("new request", "target", req.GetConnect(), "chan_id", id)
 
-	err := device.Connect(req)
+	err := device.Connect(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
 	select {
-	case conn := <-ch:
-		return conn, nil
+	case resp := <-ch:
+		if resp.err != nil {
+			resp.conn.Close()
+			return nil, resp.err
+		}
+		return s.trackStream(device, req.GetConnect(), resp.conn), nil
 	case <-time.After(time.Second * 10):
 		return nil, fmt.Errorf("timeout")
 	case <-ctx.Done():
@@ -82,18 +227,43 @@ func (s *Server) OpenStream(ctx context.Context, req *protomsg.Request) (net.Con
 	}
 }
 
+func (s *Server) trackStream(device *Session, connect *protomsg.Connect, conn net.Conn) net.Conn {
+	e := device.event(EventStreamOpen)
+	e.StreamID = connect.GetId()
+	e.Target = connect.HostPort()
+	s.events.publish(e)
+
+	return &streamConn{
+		Conn: conn,
+		onClose: func() {
+			e.Type = EventStreamClose
+			e.Time = time.Now()
+			s.events.publish(e)
+		},
+	}
+}
+
 func (s *Server) Close() error {
+	s.devices.devices.Range(func(uuid string, session *Session) bool {
+		_ = session.Close()
+		return true
+	})
 	return nil
 }
 
+type response struct {
+	conn net.Conn
+	err  error
+}
+
 type Chan struct {
-	IDChan syncmap.SyncMap[uint64, chan net.Conn]
+	IDChan syncmap.SyncMap[uint64, chan response]
 	ID     atomic.Uint64
 }
 
-func (c *Chan) NewChan() (uint64, chan net.Conn) {
+func (c *Chan) NewChan() (uint64, chan response) {
 	id := c.ID.Add(1)
-	ch := make(chan net.Conn, 2)
+	ch := make(chan response, 2)
 	c.IDChan.Store(id, ch)
 
 	return id, ch
@@ -101,102 +271,12 @@ func (c *Chan) NewChan() (uint64, chan net.Conn) {
 
 func (c *Chan) RemoveChan(id uint64) { c.IDChan.Delete(id) }
 
-func (c *Chan) SendChan(id uint64, conn net.Conn) {
+func (c *Chan) SendChan(id uint64, conn net.Conn, err error) {
 	slog.Debug("send resp to conn id", "conn_id", id)
 	ch, ok := c.IDChan.Load(id)
 	if !ok {
 		conn.Close()
 		return
 	}
-	ch <- conn
-}
-
-type Devices struct {
-	mu      sync.Mutex
-	devices syncmap.SyncMap[string, *Device]
-}
-
-func (d *Devices) RegisterDevice(uuid string, conn net.Conn) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-
-	dd, ok := d.devices.LoadAndDelete(uuid)
-	if ok {
-		dd.conn.Close()
-	}
-
-	device := NewDevice(conn)
-
-	d.devices.Store(uuid, device)
-
-	if err := protomsg.SendOk(conn); err != nil {
-		conn.Close()
-		return err
-	}
-
-	slog.Debug("new device", "uuid", uuid)
-
-	go func() {
-		defer func() {
-			d.mu.Lock()
-			defer d.mu.Unlock()
-			dv, ok := d.devices.LoadAndDelete(uuid)
-			if ok {
-				slog.Debug("delete device", "uuid", uuid)
-				dv.conn.Close()
-			}
-			_ = conn.Close()
-		}()
-
-		device.Keepalive()
-
-		for {
-			req, err := protomsg.GetRequestReader(conn)
-			if err != nil {
-				slog.Error("get req failed", "err", err, "uuid", uuid)
-				return
-			}
-
-			switch req.GetType() {
-			case protomsg.Type_Ping:
-				protomsg.SendPong(conn)
-
-			case protomsg.Type_Pong:
-				device.pongChan <- struct{}{}
-			}
-		}
-	}()
-
-	return nil
-}
-
-type Device struct {
-	conn     net.Conn
-	pongChan chan struct{}
+	ch <- response{conn, err}
 }
-
-func NewDevice(conn net.Conn) *Device { return &Device{conn, make(chan struct{}, 5)} }
-func (d *Device) Keepalive() {
-	go func() {
-		ticker := time.NewTicker(time.Second * 15)
-		defer ticker.Stop()
-
-		for range ticker.C {
-			if err := protomsg.SendPing(d.conn); err != nil {
-				slog.Error("send ping failed", "err", err)
-				d.conn.Close()
-				return
-			}
-
-			select {
-			case <-d.pongChan:
-			case <-time.After(time.Second * 10):
-				slog.Error("ping timeout")
-				d.conn.Close()
-				return
-			}
-		}
-	}()
-}
-
-func (d *Device) Connect(req *protomsg.Request) error { return protomsg.SendRequest(d.conn, req) }
@@ -0,0 +1,609 @@
+package tunnelserver_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Asutorufa/tunnel/pkg/accesslog"
+	tunnelclient "github.com/Asutorufa/tunnel/pkg/client"
+	"github.com/Asutorufa/tunnel/pkg/protomsg"
+	tunnelserver "github.com/Asutorufa/tunnel/pkg/server"
+	"github.com/Asutorufa/tunnel/pkg/tunneltest"
+)
+
+func TestOpenStream(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	h.NewDevice("dev1")
+	port := tunneltest.EchoServer(t)
+
+	conn, err := h.Server.OpenStream(context.Background(), protomsg.NewConnect("dev1", "127.0.0.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tunneltest.AssertEcho(t, conn)
+}
+
+func TestOpenStreamUnknownDevice(t *testing.T) {
+	h := tunneltest.NewServer(t)
+
+	_, err := h.Server.OpenStream(context.Background(), protomsg.NewConnect("nodev", "127.0.0.1", 22))
+	if err == nil {
+		t.Fatal("expect error for unknown device")
+	}
+}
+
+func TestOpenStreamDialFailed(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	h.NewDevice("dev1")
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := uint16(lis.Addr().(*net.TCPAddr).Port)
+	lis.Close()
+
+	start := time.Now()
+	_, err = h.Server.OpenStream(context.Background(), protomsg.NewConnect("dev1", "127.0.0.1", port))
+	if err == nil {
+		t.Fatal("expect dial error")
+	}
+	if time.Since(start) > time.Second*5 {
+		t.Errorf("dial error should not wait for the timeout: %v", time.Since(start))
+	}
+}
+
+func TestRequester(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	h.NewDevice("dev1")
+	port := tunneltest.EchoServer(t)
+
+	requester := h.NewClient("requester")
+
+	req := protomsg.NewConnect("dev1", "", port)
+	req.GetConnect().Ack = true
+	conn, err := requester.OpenStream(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tunneltest.AssertEcho(t, conn)
+
+	req = protomsg.NewConnect("nodev", "", port)
+	req.GetConnect().Ack = true
+	if _, err := requester.OpenStream(context.Background(), req); err == nil {
+		t.Fatal("expect error for unknown device")
+	}
+}
+
+func TestPingPong(t *testing.T) {
+	h := tunneltest.NewServer(t)
+
+	conn, err := net.Dial("tcp", h.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := protomsg.SendRegister(conn, &protomsg.Device{Uuid: "raw"}); err != nil {
+		t.Fatal(err)
+	}
+	h.WaitOnline("raw")
+
+	if err := protomsg.SendPing(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	req, err := protomsg.GetRequestReader(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.GetType() != protomsg.Type_Pong {
+		t.Fatalf("expect pong, got %v", req.GetType())
+	}
+
+	conn.Close()
+	h.WaitOffline("raw")
+}
+
+func TestReplaceDevice(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	port := tunneltest.EchoServer(t)
+
+	first := h.NewDevice("dev1")
+	events, unsubscribe := h.Server.Subscribe()
+	defer unsubscribe()
+
+	// stop the first device from coming back, then replace it
+	first.Close()
+	h.WaitOffline("dev1")
+	h.NewDevice("dev1")
+
+	conn, err := h.Server.OpenStream(context.Background(), protomsg.NewConnect("dev1", "127.0.0.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tunneltest.AssertEcho(t, conn)
+
+	var types []tunnelserver.EventType
+	for len(types) < 2 {
+		select {
+		case e := <-events:
+			types = append(types, e.Type)
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timeout waiting for events, got %v", types)
+		}
+	}
+	if types[0] != tunnelserver.EventDisconnected || types[1] != tunnelserver.EventRegistered {
+		t.Fatalf("unexpected events: %v", types)
+	}
+}
+
+func TestKeepaliveTimeout(t *testing.T) {
+	h := tunneltest.NewServer(t, func(s *tunnelserver.Server) {
+		s.Keepalive = protomsg.KeepaliveConfig{Interval: time.Millisecond * 50, Timeout: time.Millisecond * 50}
+	})
+	events, unsubscribe := h.Server.Subscribe()
+	defer unsubscribe()
+
+	conn, err := net.Dial("tcp", h.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// register and never answer pings
+	if err := protomsg.SendRegister(conn, &protomsg.Device{Uuid: "silent"}); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _, _ = io.Copy(io.Discard, conn) }()
+
+	for {
+		select {
+		case e := <-events:
+			if e.Type == tunnelserver.EventKeepaliveTimeout {
+				if stats, ok := h.Server.Stats("silent"); ok {
+					t.Fatalf("expired device still has stats: %+v", stats)
+				}
+				return
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("device did not time out")
+		}
+	}
+}
+
+func FuzzHandle(f *testing.F) {
+	frame := func(req *protomsg.Request) []byte {
+		buf := &bytes.Buffer{}
+		_ = protomsg.SendRequest(buf, req)
+		return buf.Bytes()
+	}
+
+	f.Add(frame(protomsg.NewConnect("dev1", "127.0.0.1", 22)))
+	f.Add(frame(&protomsg.Request{Type: protomsg.Type_Register, Payload: &protomsg.Request_Device{Device: &protomsg.Device{Uuid: "dev1"}}}))
+	f.Add(frame(&protomsg.Request{Type: protomsg.Type_Response, Payload: &protomsg.Request_ConnectResponse{ConnectResponse: &protomsg.ConnectResponse{Connid: 1}}}))
+	f.Add(frame(&protomsg.Request{Type: protomsg.Type_Ping}))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s := tunnelserver.NewServer()
+		defer s.Close()
+
+		server, client := net.Pipe()
+		defer client.Close()
+
+		go func() { _, _ = io.Copy(io.Discard, client) }()
+		go func() {
+			_ = client.SetWriteDeadline(time.Now().Add(time.Second))
+			_, _ = client.Write(data)
+			_ = client.Close()
+		}()
+
+		_ = s.Handle(server)
+		server.Close()
+	})
+}
+
+func TestHandleMalformed(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		req  *protomsg.Request
+	}{
+		{"register without device", &protomsg.Request{Type: protomsg.Type_Register}},
+		{"register without uuid", &protomsg.Request{Type: protomsg.Type_Register, Payload: &protomsg.Request_Device{Device: &protomsg.Device{}}}},
+		{"connection without connect", &protomsg.Request{Type: protomsg.Type_Connection}},
+		{"response without payload", &protomsg.Request{Type: protomsg.Type_Response}},
+		{"unknown type", &protomsg.Request{Type: protomsg.Type(100)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tunnelserver.NewServer()
+
+			server, client := net.Pipe()
+			defer client.Close()
+			go func() { _ = protomsg.SendRequest(client, tt.req) }()
+
+			if err := s.Handle(server); err == nil {
+				t.Fatal("expect error")
+			}
+		})
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	s := tunnelserver.NewServer()
+	s.HandshakeTimeout = time.Millisecond * 100
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() { _, _ = client.Write([]byte{0, 0, 0}) }()
+
+	done := make(chan error, 1)
+	go func() { done <- s.Handle(server) }()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expect deadline exceeded, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("handle did not time out")
+	}
+}
+
+func TestReplaceSession(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	events, unsubscribe := h.Server.Subscribe()
+	defer unsubscribe()
+
+	register := func() net.Conn {
+		conn, err := net.Dial("tcp", h.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+
+		if err := protomsg.SendRegister(conn, &protomsg.Device{Uuid: "dev1"}); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	expect := func(typ tunnelserver.EventType, generation uint64) {
+		t.Helper()
+		select {
+		case e := <-events:
+			if e.Type != typ || e.UUID != "dev1" || e.Generation != generation {
+				t.Fatalf("expect %v generation %d, got %+v", typ, generation, e)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timeout waiting for %v", typ)
+		}
+	}
+
+	first := register()
+	expect(tunnelserver.EventRegistered, 1)
+
+	second := register()
+	expect(tunnelserver.EventReplaced, 1)
+	expect(tunnelserver.EventRegistered, 2)
+
+	// the old connection is closed and its cleanup must not remove the new session
+	_ = first.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := protomsg.GetRequestReader(first); !errors.Is(err, io.EOF) {
+		t.Fatalf("expect old session closed, got %v", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if !h.Server.Online("dev1") {
+		t.Fatal("new session was removed by the old one")
+	}
+
+	second.Close()
+	expect(tunnelserver.EventDisconnected, 2)
+	h.WaitOffline("dev1")
+}
+
+func TestKeepaliveRTT(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	device := h.NewDevice("dev1", func(c *tunnelclient.Client) {
+		c.Keepalive = protomsg.KeepaliveConfig{Interval: time.Millisecond * 20, Timeout: time.Second}
+	})
+
+	// the server clamps the interval asked by the device to one second
+	tunneltest.Eventually(t, func() bool {
+		stats, ok := h.Server.Stats("dev1")
+		return ok && stats.Received >= 1 && stats.RTT > 0 && stats.SRTT > 0
+	}, "server rtt")
+
+	tunneltest.Eventually(t, func() bool {
+		stats, ok := device.Stats()
+		return ok && stats.Received >= 3 && stats.RTT > 0 && stats.Lost == 0
+	}, "client rtt")
+}
+
+func TestStreamEvents(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	h.NewDevice("dev1")
+	port := tunneltest.EchoServer(t)
+
+	events, unsubscribe := h.Server.Subscribe()
+	defer unsubscribe()
+
+	conn, err := h.Server.OpenStream(context.Background(), protomsg.NewConnect("dev1", "127.0.0.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunneltest.AssertEcho(t, conn)
+	conn.Close()
+	conn.Close()
+
+	target := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port)))
+	for _, typ := range []tunnelserver.EventType{tunnelserver.EventStreamOpen, tunnelserver.EventStreamClose} {
+		select {
+		case e := <-events:
+			if e.Type != typ || e.UUID != "dev1" || e.Target != target || e.StreamID == 0 {
+				t.Fatalf("expect %v, got %+v", typ, e)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timeout waiting for %v", typ)
+		}
+	}
+
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event %+v", e)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestStreamHalfClose(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	h.NewDevice("dev1")
+	port := tunneltest.EchoServer(t)
+
+	conn, err := h.Server.OpenStream(context.Background(), protomsg.NewConnect("dev1", "127.0.0.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		t.Fatal("stream should support half close")
+	}
+
+	if _, err := conn.Write([]byte("half")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "half" {
+		t.Fatalf("unexpected echo: %q", data)
+	}
+}
+
+type accessRecords chan accesslog.Record
+
+func (r accessRecords) Log(rec accesslog.Record) { r <- rec }
+
+func (r accessRecords) next(t *testing.T) accesslog.Record {
+	t.Helper()
+	select {
+	case rec := <-r:
+		return rec
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for access log")
+		return accesslog.Record{}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	serverLog, deviceLog := make(accessRecords, 4), make(accessRecords, 4)
+
+	h := tunneltest.NewServer(t, func(s *tunnelserver.Server) { s.AccessLog = serverLog })
+	h.NewDevice("dev1", func(c *tunnelclient.Client) { c.AccessLog = deviceLog })
+	port := tunneltest.EchoServer(t)
+
+	req := protomsg.NewConnect("dev1", "127.0.0.1", port)
+	req.GetConnect().Ack = true
+	conn, err := h.NewClient("requester").OpenStream(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunneltest.AssertEcho(t, conn)
+	conn.Close()
+
+	target := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port)))
+	for _, rec := range []accesslog.Record{serverLog.next(t), deviceLog.next(t)} {
+		if rec.Device != "dev1" || rec.Target != target || rec.Reason != accesslog.ReasonClosed {
+			t.Fatalf("unexpected record: %+v", rec)
+		}
+		if rec.BytesIn != 12 || rec.BytesOut != 12 {
+			t.Fatalf("unexpected bytes: %+v", rec)
+		}
+	}
+
+	_, err = h.NewClient("requester").OpenStream(context.Background(), protomsg.NewConnect("dev2", "127.0.0.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := serverLog.next(t); rec.Reason != accesslog.ReasonOpenFailed || rec.Frontend != "tunnel" || rec.Requester == "" {
+		t.Fatalf("unexpected record: %+v", rec)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	port := tunneltest.EchoServer(t)
+
+	events, unsubscribe := h.Server.Subscribe()
+	defer unsubscribe()
+
+	advertise := func(routes ...string) func(*tunnelclient.Client) {
+		return func(c *tunnelclient.Client) {
+			for _, r := range routes {
+				c.Routes = append(c.Routes, netip.MustParsePrefix(r))
+			}
+		}
+	}
+
+	expect := func(typ tunnelserver.EventType, uuid string) tunnelserver.Event {
+		t.Helper()
+		for {
+			select {
+			case e := <-events:
+				if e.Type == typ {
+					if e.UUID != uuid {
+						t.Fatalf("expect %v for %s, got %+v", typ, uuid, e)
+					}
+					return e
+				}
+			case <-time.After(time.Second * 5):
+				t.Fatalf("timeout waiting for %v", typ)
+			}
+		}
+	}
+
+	dev1 := h.NewDevice("dev1", advertise("127.0.0.0/8"))
+	dev2 := h.NewDevice("dev2", advertise("127.0.0.1/32"))
+	h.NewDevice("dev3", advertise("127.0.0.0/8", "10.0.0.0/8"))
+
+	if e := expect(tunnelserver.EventRouteConflict, "dev3"); e.Target != "127.0.0.0/8" {
+		t.Fatalf("expect conflict on 127.0.0.0/8, got %+v", e)
+	}
+
+	owners := func() map[string]string {
+		m := map[string]string{}
+		for _, r := range h.Server.Routes() {
+			m[r.Prefix.String()] = r.UUID
+		}
+		return m
+	}
+	if routes := h.Server.Routes(); len(routes) != 3 || routes[0].UUID != "dev2" {
+		t.Fatalf("unexpected routes %+v", routes)
+	}
+	if o := owners(); o["127.0.0.0/8"] != "dev1" || o["10.0.0.0/8"] != "dev3" {
+		t.Fatalf("unexpected owners %v", o)
+	}
+
+	// the first device keeps its prefix across a reconnect
+	dev1.Reconnect()
+	expect(tunnelserver.EventRegistered, "dev1")
+	if o := owners(); o["127.0.0.0/8"] != "dev1" {
+		t.Fatalf("expect dev1 to keep 127.0.0.0/8 after a reconnect, got %v", o)
+	}
+
+	requester := h.NewClient("requester")
+	open := func(uuid string, exit bool) {
+		t.Helper()
+
+		req := protomsg.NewConnect("", "127.0.0.1", port)
+		if exit {
+			req = protomsg.NewConnect("exit1", "127.0.0.1", port)
+			req.GetConnect().Exit = true
+		}
+		req.GetConnect().Ack = true
+		conn, err := requester.OpenStream(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		tunneltest.AssertEcho(t, conn)
+		expect(tunnelserver.EventStreamOpen, uuid)
+	}
+
+	// longest prefix wins
+	open("dev2", false)
+
+	_ = dev2.Close()
+	h.WaitOffline("dev2")
+	open("dev1", false)
+
+	// advertised prefixes take precedence over the exit node
+	open("dev1", true)
+
+	req := protomsg.NewConnect("", "192.168.1.1", 80)
+	req.GetConnect().Ack = true
+	if _, err := requester.OpenStream(context.Background(), req); err == nil {
+		t.Fatal("expect no route error")
+	}
+}
+
+func TestRegisterInvalidRoute(t *testing.T) {
+	h := tunneltest.NewServer(t)
+
+	conn, err := net.Dial("tcp", h.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+	if err := protomsg.SendRegister(conn, &protomsg.Device{Uuid: "dev1", Routes: []string{"192.168.1.0"}}); err == nil {
+		t.Fatal("register with an invalid route should be refused")
+	}
+	if h.Server.Online("dev1") {
+		t.Fatal("device with an invalid route is online")
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+	h := tunneltest.NewServer(t)
+
+	conn, err := net.Dial("tcp", h.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+	err = protomsg.SendRegister(conn, &protomsg.Device{Uuid: "new", Hello: &protomsg.Hello{Protocol: 9, MinProtocol: 9, Version: "v9"}})
+	if err == nil || !strings.Contains(err.Error(), "upgrade server") {
+		t.Fatalf("expect a device of a newer protocol refused, got %v", err)
+	}
+
+	// a device from before versioning has no features
+	old, err := net.Dial("tcp", h.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	if err := protomsg.SendRegister(old, &protomsg.Device{Uuid: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	h.WaitOnline("old")
+
+	requester := h.NewDevice("requester")
+	req := protomsg.Target{UUID: "old", Address: "127.0.0.1", Port: 53, Network: protomsg.NetworkUDP}.NewConnect()
+	req.GetConnect().Ack = true
+	_, err = requester.OpenStream(context.Background(), req)
+	if err == nil || !strings.Contains(err.Error(), "does not support udp") {
+		t.Fatalf("expect udp to an old device refused, got %v", err)
+	}
+
+	if st := requester.Status(); st.Protocol != protomsg.ProtocolVersion || st.Features != protomsg.SupportedFeatures.String() {
+		t.Errorf("unexpected negotiated protocol %d and features %s", st.Protocol, st.Features)
+	}
+}
@@ -0,0 +1,242 @@
+package tunnelserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Asutorufa/tunnel/pkg/protomsg"
+	"github.com/Asutorufa/yuhaiin/pkg/utils/syncmap"
+)
+
+type Devices struct {
+	mu         sync.Mutex
+	devices    syncmap.SyncMap[string, *Session]
+	generation atomic.Uint64
+	events     *broker
+	routes     atomic.Pointer[[]Route]
+	// claims are guarded by mu
+	claims claims
+}
+
+func (d *Devices) RegisterDevice(device *protomsg.Device, conn net.Conn, keepalive protomsg.KeepaliveConfig) error {
+	uuid := device.GetUuid()
+	if uuid == "" {
+		return fmt.Errorf("%w: register without uuid", protomsg.ErrInvalidMessage)
+	}
+
+	routes, err := parseRoutes(device)
+	if err != nil {
+		return err
+	}
+
+	if err := protomsg.CheckHello("server", "device "+uuid, device.GetHello()); err != nil {
+		_ = protomsg.SendError(conn, err)
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	session := NewSession(uuid, d.generation.Add(1), conn, keepalive)
+	session.Routes = routes
+	session.ExitNode = device.GetExitNode()
+	session.Hello = device.GetHello()
+
+	if err := session.writer.Send(context.TODO(), protomsg.NewOk()); err != nil {
+		session.Close()
+		return err
+	}
+
+	if old, ok := d.devices.Load(uuid); ok {
+		old.Close()
+		d.events.publish(old.event(EventReplaced))
+	}
+
+	d.devices.Store(uuid, session)
+	if d.claims == nil {
+		d.claims = claims{}
+	}
+	d.claims.claim(uuid, routes)
+	d.updateRoutes()
+	d.events.publish(session.event(EventRegistered))
+	d.checkRoutes(session)
+
+	slog.Debug("new device", "uuid", uuid, "generation", session.Generation,
+		"version", session.Hello.GetVersion(), "protocol", session.Hello.GetProtocol(), "features", session.Features())
+
+	go d.serve(session)
+
+	return nil
+}
+
+// remove deletes the session only if it is still the current one for its
+// uuid, a newer registration must not be removed by an old connection.
+func (d *Devices) remove(session *Session) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if cur, ok := d.devices.Load(session.UUID); ok && cur == session {
+		d.devices.Delete(session.UUID)
+		d.updateRoutes()
+
+		e := session.event(EventDisconnected)
+		if errors.Is(session.err, protomsg.ErrKeepaliveTimeout) {
+			e.Type = EventKeepaliveTimeout
+		}
+		if session.err != nil {
+			e.Error = session.err.Error()
+		}
+		d.events.publish(e)
+		slog.Debug("delete device", "uuid", session.UUID, "generation", session.Generation)
+	}
+}
+
+// checkRoutes reports prefixes of a new session that are owned by a device
+// that advertised them first, the owner keeps them until it goes away.
+func (d *Devices) checkRoutes(session *Session) {
+	for _, r := range d.Routes() {
+		if r.UUID == session.UUID || !slices.Contains(session.Routes, r.Prefix) {
+			continue
+		}
+
+		e := session.event(EventRouteConflict)
+		e.Target = r.Prefix.String()
+		e.Error = fmt.Sprintf("already advertised by %s", r.UUID)
+		d.events.publish(e)
+		slog.Warn("route conflict", "prefix", r.Prefix, "uuid", session.UUID, "owner", r.UUID)
+	}
+}
+
+func (d *Devices) updateRoutes() {
+	var sessions []*Session
+	d.devices.Range(func(_ string, session *Session) bool {
+		sessions = append(sessions, session)
+		return true
+	})
+	routes := buildRoutes(sessions, d.claims)
+	d.routes.Store(&routes)
+}
+
+// Routes returns the routing table, longest prefix first.
+func (d *Devices) Routes() []Route {
+	if routes := d.routes.Load(); routes != nil {
+		return *routes
+	}
+	return nil
+}
+
+func (d *Devices) Lookup(addr netip.Addr) (string, bool) {
+	return lookupRoute(d.Routes(), addr)
+}
+
+func (d *Devices) serve(session *Session) {
+	defer func() {
+		_ = session.Close()
+		d.remove(session)
+	}()
+
+	session.Keepalive()
+
+	for {
+		req, err := protomsg.GetRequestReader(session.conn)
+		if err != nil {
+			_ = session.closeWithError(err)
+			slog.Error("get req failed", "err", err, "uuid", session.UUID, "generation", session.Generation)
+			return
+		}
+
+		switch req.GetType() {
+		case protomsg.Type_Ping:
+			if err := session.writer.SendPriority(context.TODO(), protomsg.NewPongFor(req.GetPing())); err != nil {
+				slog.Error("send pong failed", "err", err, "uuid", session.UUID)
+				return
+			}
+
+		case protomsg.Type_Pong:
+			session.keepalive.HandlePong(req.GetPong())
+		}
+	}
+}
+
+// Session is one registration of a device, a reconnect of the same uuid
+// creates a new session with a higher generation.
+type Session struct {
+	UUID       string
+	Generation uint64
+	Remote     net.Addr
+	Registered time.Time
+	// Routes are the prefixes the device advertised
+	Routes []netip.Prefix
+	// ExitNode devices accept general traffic of requesters
+	ExitNode bool
+	// Hello is the protocol version and features of the device, nil for
+	// devices from before versioning
+	Hello *protomsg.Hello
+
+	conn      net.Conn
+	writer    *protomsg.Writer
+	keepalive *protomsg.Keepalive
+	closed    chan struct{}
+	once      sync.Once
+	// err is why the session was closed, read it only after closed
+	err error
+}
+
+func NewSession(uuid string, generation uint64, conn net.Conn, keepalive protomsg.KeepaliveConfig) *Session {
+	return &Session{
+		UUID:       uuid,
+		Generation: generation,
+		Remote:     conn.RemoteAddr(),
+		Registered: time.Now(),
+		conn:       conn,
+		writer:     protomsg.NewWriter(conn, 16, time.Second*10),
+		keepalive:  protomsg.NewKeepalive(keepalive),
+		closed:     make(chan struct{}),
+	}
+}
+
+func (s *Session) Keepalive() {
+	go func() {
+		if err := s.keepalive.Run(s.writer, s.closed); err != nil {
+			slog.Error("keepalive failed", "err", err, "uuid", s.UUID, "generation", s.Generation)
+			_ = s.closeWithError(err)
+		}
+	}()
+}
+
+func (s *Session) Features() protomsg.Features { return s.Hello.FeatureSet() }
+
+func (s *Session) Stats() protomsg.KeepaliveStats { return s.keepalive.Stats() }
+
+func (s *Session) Connect(ctx context.Context, req *protomsg.Request) error {
+	return s.writer.Send(ctx, req)
+}
+
+func (s *Session) Close() error { return s.closeWithError(nil) }
+
+func (s *Session) closeWithError(err error) error {
+	s.once.Do(func() {
+		s.err = err
+		close(s.closed)
+	})
+	_ = s.writer.Close()
+	return s.conn.Close()
+}
+
+func (s *Session) event(t EventType) Event {
+	return Event{
+		Type:       t,
+		UUID:       s.UUID,
+		Generation: s.Generation,
+		Remote:     s.Remote.String(),
+		Time:       time.Now(),
+	}
+}
@@ -0,0 +1,150 @@
+// Package tun turns tcp and udp flows from a tun interface into tunnel
+// streams, so that applications without proxy support can reach devices by
+// address.
+package tun
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/Asutorufa/tunnel/pkg/accesslog"
+	"github.com/Asutorufa/tunnel/pkg/api"
+	"github.com/Asutorufa/tunnel/pkg/fakedns"
+	"github.com/Asutorufa/tunnel/pkg/protomsg"
+)
+
+const DefaultMTU = 1500
+
+type Config struct {
+	// Name of the interface, like tunnel0
+	Name string
+	MTU  int
+	// Subnets assigns virtual subnets to devices
+	Subnets []Subnet
+	// Routes are routed to the interface besides the subnets, like the
+	// fake ip range
+	Routes []netip.Prefix
+	// DNS answers udp port 53 on the interface
+	DNS *fakedns.Server
+}
+
+// Subnet maps the addresses of Prefix to a device, the host bits are kept
+// in Target or the flow goes to 127.0.0.1 on the device without it.
+type Subnet struct {
+	Device string
+	Prefix netip.Prefix
+	Target netip.Prefix
+}
+
+// ParseSubnet parses "device=prefix[=target]", like
+// "dev1=100.64.3.0/24=192.168.1.0/24".
+func ParseSubnet(s string) (Subnet, error) {
+	parts := strings.Split(s, "=")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+		return Subnet{}, fmt.Errorf("invalid subnet %q, expect device=prefix[=target]", s)
+	}
+
+	prefix, err := netip.ParsePrefix(parts[1])
+	if err != nil {
+		return Subnet{}, fmt.Errorf("invalid subnet %q: %w", s, err)
+	}
+
+	subnet := Subnet{Device: parts[0], Prefix: prefix.Masked()}
+	if len(parts) == 3 {
+		target, err := netip.ParsePrefix(parts[2])
+		if err != nil {
+			return Subnet{}, fmt.Errorf("invalid subnet %q: %w", s, err)
+		}
+		if target.Bits() != prefix.Bits() || target.Addr().Is4() != prefix.Addr().Is4() {
+			return Subnet{}, fmt.Errorf("invalid subnet %q: prefix and target must have the same size", s)
+		}
+		subnet.Target = target.Masked()
+	}
+
+	return subnet, nil
+}
+
+// Map returns the address on the device for addr.
+func (s Subnet) Map(addr netip.Addr) netip.Addr {
+	if !s.Target.IsValid() {
+		return netip.AddrFrom4([4]byte{127, 0, 0, 1})
+	}
+
+	a, t := addr.AsSlice(), s.Target.Addr().AsSlice()
+	for i := s.Prefix.Bits(); i < len(a)*8; i++ {
+		bit := byte(1) << (7 - i%8)
+		t[i/8] = t[i/8]&^bit | a[i/8]&bit
+	}
+
+	mapped, _ := netip.AddrFromSlice(t)
+	return mapped
+}
+
+// TUN is an open tun interface.
+type TUN struct {
+	config Config
+	dialer *api.Dialer
+	close  func() error
+}
+
+// Open creates the interface, routes the subnets to it and serves its flows
+// with d until it is closed.
+func Open(config Config, d *api.Dialer) (*TUN, error) {
+	if config.MTU == 0 {
+		config.MTU = DefaultMTU
+	}
+
+	t := &TUN{config: config, dialer: d}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *TUN) Close() error { return t.close() }
+
+func (t *TUN) routes() []netip.Prefix {
+	routes := append([]netip.Prefix(nil), t.config.Routes...)
+	for _, s := range t.config.Subnets {
+		routes = append(routes, s.Prefix)
+	}
+	return routes
+}
+
+func (t *TUN) resolve(dst netip.AddrPort) (protomsg.Target, bool) {
+	addr := dst.Addr().Unmap()
+	for _, s := range t.config.Subnets {
+		if s.Prefix.Contains(addr) {
+			return protomsg.Target{UUID: s.Device, Address: s.Map(addr).String(), Port: dst.Port()}, true
+		}
+	}
+	return protomsg.Target{}, false
+}
+
+// dial opens the stream of a flow from src to dst, addresses outside the
+// subnets are left to the dialer, which maps fake ips back to names.
+func (t *TUN) dial(ctx context.Context, src, dst netip.AddrPort) (net.Conn, error) {
+	ctx = accesslog.WithSource(ctx, accesslog.Source{Frontend: "tun", Addr: src.String()})
+
+	if target, ok := t.resolve(dst); ok {
+		req := protomsg.NewConnect(target.UUID, target.Address, target.Port)
+		req.GetConnect().Ack = true
+		return t.dialer.Tunnel.OpenStream(ctx, req)
+	}
+
+	return t.dialer.DialContext(ctx, "tcp", dst.String())
+}
+
+// dialUDP opens the udp stream of a flow to target in a subnet, the
+// datagrams on it are framed by protomsg.WritePacket.
+func (t *TUN) dialUDP(ctx context.Context, src netip.AddrPort, target protomsg.Target) (net.Conn, error) {
+	ctx = accesslog.WithSource(ctx, accesslog.Source{Frontend: "tun", Addr: src.String()})
+
+	target.Network = protomsg.NetworkUDP
+	req := target.NewConnect()
+	req.GetConnect().Ack = true
+	return t.dialer.Tunnel.OpenStream(ctx, req)
+}
@@ -0,0 +1,235 @@
+//go:build linux
+
+package tun
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/Asutorufa/tunnel/pkg/protomsg"
+	"github.com/Asutorufa/yuhaiin/pkg/utils/relay"
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/link/tun"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const nicID tcpip.NICID = 1
+
+// udpIdleTimeout closes the stream of a udp flow without datagrams.
+const udpIdleTimeout = time.Minute
+
+func (t *TUN) open() error {
+	fd, err := tun.Open(t.config.Name)
+	if err != nil {
+		return fmt.Errorf("open tun %s: %w", t.config.Name, err)
+	}
+
+	ep, err := fdbased.New(&fdbased.Options{FDs: []int{fd}, MTU: uint32(t.config.MTU)})
+	if err != nil {
+		_ = unix.Close(fd)
+		return fmt.Errorf("new tun endpoint: %w", err)
+	}
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+
+	t.close = func() error {
+		s.Close()
+		s.Wait()
+		return nil
+	}
+
+	if err := s.CreateNIC(nicID, ep); err != nil {
+		_ = t.close()
+		return fmt.Errorf("create nic: %s", err)
+	}
+
+	// accept flows to any address, the kernel only routes the subnets here
+	_ = s.SetPromiscuousMode(nicID, true)
+	_ = s.SetSpoofing(nicID, true)
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: nicID},
+		{Destination: header.IPv6EmptySubnet, NIC: nicID},
+	})
+
+	tcpForwarder := tcp.NewForwarder(s, 0, 1024, t.acceptTCP)
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+
+	udpForwarder := udp.NewForwarder(s, t.acceptUDP)
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+
+	if err := t.configure(); err != nil {
+		_ = t.close()
+		return err
+	}
+
+	return nil
+}
+
+// configure brings the interface up and routes the subnets to it.
+func (t *TUN) configure() error {
+	cmds := [][]string{{"link", "set", "dev", t.config.Name, "mtu", strconv.Itoa(t.config.MTU), "up"}}
+	for _, p := range t.routes() {
+		cmds = append(cmds, []string{"route", "replace", p.String(), "dev", t.config.Name})
+	}
+
+	for _, args := range cmds {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("ip %v: %w: %s", args, err, out)
+		}
+	}
+	return nil
+}
+
+func (t *TUN) acceptTCP(r *tcp.ForwarderRequest) {
+	id := r.ID()
+	src := addrPort(id.RemoteAddress, id.RemotePort)
+	dst := addrPort(id.LocalAddress, id.LocalPort)
+
+	// the handshake is completed after the stream is open, so that a
+	// failed stream resets the connection
+	go func() {
+		remote, err := t.dial(context.TODO(), src, dst)
+		if err != nil {
+			slog.Error("open stream failed", "src", src, "dst", dst, "err", err)
+			r.Complete(true)
+			return
+		}
+		defer remote.Close()
+
+		var wq waiter.Queue
+		ep, terr := r.CreateEndpoint(&wq)
+		if terr != nil {
+			slog.Error("create endpoint failed", "src", src, "dst", dst, "err", terr)
+			r.Complete(true)
+			return
+		}
+		r.Complete(false)
+
+		conn := gonet.NewTCPConn(&wq, ep)
+		defer conn.Close()
+
+		relay.Relay(remote, conn)
+	}()
+}
+
+// acceptUDP relays the flows to the subnets as udp streams, dns of the
+// other routed addresses is answered on port 53 and the rest is dropped.
+func (t *TUN) acceptUDP(r *udp.ForwarderRequest) {
+	id := r.ID()
+	src := addrPort(id.RemoteAddress, id.RemotePort)
+	dst := addrPort(id.LocalAddress, id.LocalPort)
+
+	target, ok := t.resolve(dst)
+	dns := !ok && t.config.DNS != nil && dst.Port() == 53
+	if !ok && !dns {
+		slog.Debug("drop udp flow outside the subnets", "src", src, "dst", dst)
+		return
+	}
+
+	var wq waiter.Queue
+	ep, err := r.CreateEndpoint(&wq)
+	if err != nil {
+		slog.Error("create udp endpoint failed", "src", src, "dst", dst, "err", err)
+		return
+	}
+	conn := gonet.NewUDPConn(&wq, ep)
+
+	if dns {
+		go t.serveDNS(conn)
+		return
+	}
+	go t.relayUDP(conn, src, dst, target)
+}
+
+// relayUDP relays the datagrams of a flow through its own stream, until
+// the flow idles.
+func (t *TUN) relayUDP(conn net.Conn, src, dst netip.AddrPort, target protomsg.Target) {
+	defer conn.Close()
+
+	remote, err := t.dialUDP(context.TODO(), src, target)
+	if err != nil {
+		slog.Error("open stream failed", "src", src, "dst", dst, "err", err)
+		return
+	}
+	defer remote.Close()
+
+	idle := time.AfterFunc(udpIdleTimeout, func() {
+		remote.Close()
+		conn.Close()
+	})
+	defer idle.Stop()
+
+	go func() {
+		defer conn.Close()
+
+		buf := make([]byte, protomsg.MaxPacketSize)
+		for {
+			n, err := protomsg.ReadPacket(remote, buf)
+			if err != nil {
+				return
+			}
+			idle.Reset(udpIdleTimeout)
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, protomsg.MaxPacketSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		idle.Reset(udpIdleTimeout)
+		if err := protomsg.WritePacket(remote, buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+func (t *TUN) serveDNS(conn net.Conn) {
+	defer conn.Close()
+
+	buf := make([]byte, 65535)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second * 30))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+
+		resp, err := t.config.DNS.Handle(buf[:n])
+		if err != nil {
+			slog.Error("dns query failed", "err", err)
+			continue
+		}
+
+		if _, err := conn.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+func addrPort(addr tcpip.Address, port uint16) netip.AddrPort {
+	a, _ := netip.AddrFromSlice(addr.AsSlice())
+	return netip.AddrPortFrom(a.Unmap(), port)
+}
@@ -0,0 +1,82 @@
+//go:build linux
+
+package tun
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Asutorufa/tunnel/pkg/api"
+	"github.com/Asutorufa/tunnel/pkg/tunneltest"
+)
+
+// TestTUN needs CAP_NET_ADMIN, run it in a network namespace:
+//
+//	TUNNEL_TUN_TEST=1 unshare -rn go test -run TestTUN ./pkg/tun
+func TestTUN(t *testing.T) {
+	if os.Getenv("TUNNEL_TUN_TEST") == "" {
+		t.Skip("TUNNEL_TUN_TEST is not set")
+	}
+
+	if out, err := exec.Command("ip", "link", "set", "lo", "up").CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	h := tunneltest.NewServer(t)
+	h.NewDevice("dev1")
+	port := tunneltest.EchoServer(t)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	tun, err := Open(Config{
+		Name:    "tunnel0",
+		Subnets: []Subnet{{Device: "dev1", Prefix: netip.MustParsePrefix("100.64.3.0/24")}},
+	}, api.NewDialer(h.Server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("100.64.3.10", strconv.Itoa(int(port))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tunneltest.AssertEcho(t, conn)
+
+	uc, err := net.Dial("udp", net.JoinHostPort("100.64.3.10", strconv.Itoa(pc.LocalAddr().(*net.UDPAddr).Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+
+	if _, err := uc.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	_ = uc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	n, err := uc.Read(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Errorf("expect udp echo over the tun, got %q %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package tun
+
+import (
+	"errors"
+	"runtime"
+)
+
+func (t *TUN) open() error {
+	return errors.Join(errors.ErrUnsupported, errors.New("tun is not supported on "+runtime.GOOS))
+}
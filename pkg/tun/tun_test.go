@@ -0,0 +1,78 @@
+package tun
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/Asutorufa/tunnel/pkg/api"
+	"github.com/Asutorufa/tunnel/pkg/fakedns"
+	"github.com/Asutorufa/tunnel/pkg/protomsg"
+	"github.com/Asutorufa/tunnel/pkg/tunneltest"
+)
+
+func TestSubnet(t *testing.T) {
+	s, err := ParseSubnet("dev1=100.64.3.0/24=192.168.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Map(netip.MustParseAddr("100.64.3.10")); got != netip.MustParseAddr("192.168.1.10") {
+		t.Fatalf("unexpected mapping %s", got)
+	}
+
+	s, err = ParseSubnet("dev1=fd7a::/120=fd00:1::/120")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Map(netip.MustParseAddr("fd7a::2a")); got != netip.MustParseAddr("fd00:1::2a") {
+		t.Fatalf("unexpected mapping %s", got)
+	}
+
+	s, err = ParseSubnet("dev1=100.64.3.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Map(netip.MustParseAddr("100.64.3.10")); got != netip.MustParseAddr("127.0.0.1") {
+		t.Fatalf("unexpected mapping %s", got)
+	}
+
+	for _, bad := range []string{"dev1", "=100.64.3.0/24", "dev1=100.64.3.0", "dev1=100.64.3.0/24=192.168.0.0/16", "dev1=100.64.3.0/24=fd00::/120"} {
+		if _, err := ParseSubnet(bad); err == nil {
+			t.Errorf("expect error for %s", bad)
+		}
+	}
+}
+
+func TestDial(t *testing.T) {
+	h := tunneltest.NewServer(t)
+	h.NewDevice("dev1")
+	port := tunneltest.EchoServer(t)
+
+	pool, err := fakedns.NewPool(fakedns.DefaultPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subnet, err := ParseSubnet("dev1=100.64.3.0/24=127.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := api.NewDialer(h.Server)
+	d.FakeIP = pool
+	tun := &TUN{config: Config{Subnets: []Subnet{subnet}}, dialer: d}
+
+	if target, ok := tun.resolve(netip.MustParseAddrPort("100.64.3.1:22")); !ok || target != (protomsg.Target{UUID: "dev1", Address: "127.0.0.1", Port: 22}) {
+		t.Fatalf("unexpected target %+v", target)
+	}
+
+	src := netip.MustParseAddrPort("100.64.0.1:40000")
+	for _, dst := range []netip.Addr{netip.MustParseAddr("100.64.3.1"), pool.Addr("dev1.tunnel")} {
+		conn, err := tun.dial(context.Background(), src, netip.AddrPortFrom(dst, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tunneltest.AssertEcho(t, conn)
+		conn.Close()
+	}
+}
@@ -0,0 +1,179 @@
+// Package tunneltest boots a tunnel server with devices and requesters on
+// loopback listeners for end-to-end tests.
+package tunneltest
+
+import (
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tunnelclient "github.com/Asutorufa/tunnel/pkg/client"
+	tunnelserver "github.com/Asutorufa/tunnel/pkg/server"
+)
+
+type Harness struct {
+	t      testing.TB
+	Server *tunnelserver.Server
+	Addr   string
+}
+
+// NewServer starts a server, opts can configure it before it serves.
+func NewServer(t testing.TB, opts ...func(*tunnelserver.Server)) *Harness {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := tunnelserver.NewServer()
+	for _, opt := range opts {
+		opt(s)
+	}
+	go func() { _ = s.Serve(lis) }()
+
+	t.Cleanup(func() {
+		_ = lis.Close()
+		_ = s.Close()
+	})
+
+	return &Harness{t: t, Server: s, Addr: lis.Addr().String()}
+}
+
+// NewDevice registers a device and keeps it registered until the test ends,
+// opts can configure the client before it registers.
+func (h *Harness) NewDevice(uuid string, opts ...func(*tunnelclient.Client)) *tunnelclient.Client {
+	h.t.Helper()
+
+	c := h.NewClient(uuid)
+	for _, opt := range opts {
+		opt(c)
+	}
+	go func() {
+		for {
+			if err := c.Register(); errors.Is(err, net.ErrClosed) {
+				return
+			}
+			time.Sleep(time.Millisecond * 50)
+		}
+	}()
+
+	h.t.Cleanup(func() { _ = c.Close() })
+
+	h.WaitOnline(uuid)
+	return c
+}
+
+// NewClient returns a client for the harness server without registering it,
+// it can be used as a requester.
+func (h *Harness) NewClient(uuid string) *tunnelclient.Client {
+	return &tunnelclient.Client{
+		UUID:   uuid,
+		Server: h.Addr,
+	}
+}
+
+func (h *Harness) WaitOnline(uuid string) {
+	h.t.Helper()
+	Eventually(h.t, func() bool { return h.Server.Online(uuid) }, "device %s online", uuid)
+}
+
+func (h *Harness) WaitOffline(uuid string) {
+	h.t.Helper()
+	Eventually(h.t, func() bool { return !h.Server.Online(uuid) }, "device %s offline", uuid)
+}
+
+func Eventually(t testing.TB, cond func() bool, format string, args ...any) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for "+format, args...)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// EchoServer starts a tcp echo server on loopback and returns its port.
+func EchoServer(t testing.TB) uint16 {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lis.Close() })
+
+	go echo(lis)
+
+	return uint16(lis.Addr().(*net.TCPAddr).Port)
+}
+
+// UnixEchoServer starts an echo server on a unix socket and returns its path.
+func UnixEchoServer(t testing.TB) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "echo.sock")
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lis.Close() })
+
+	go echo(lis)
+
+	return path
+}
+
+func echo(lis net.Listener) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+			_, _ = io.Copy(conn, conn)
+		}()
+	}
+}
+
+// FreeAddr returns a loopback address that was free when it was checked.
+func FreeAddr(t testing.TB) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	return lis.Addr().String()
+}
+
+// AssertEcho writes a message to conn and expects to read it back.
+func AssertEcho(t testing.TB, conn net.Conn) {
+	t.Helper()
+
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+	defer conn.SetDeadline(time.Time{})
+
+	msg := []byte("hello tunnel")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != string(msg) {
+		t.Fatalf("echo mismatch: %q", buf)
+	}
+}
@@ -0,0 +1,127 @@
+package upstream_test
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/Asutorufa/tunnel/pkg/api"
+	"github.com/Asutorufa/tunnel/pkg/auth"
+	"github.com/Asutorufa/tunnel/pkg/tunneltest"
+	"github.com/Asutorufa/tunnel/pkg/upstream"
+	"github.com/Asutorufa/yuhaiin/pkg/net/netapi"
+)
+
+func proxies(t *testing.T) (socks5, http string) {
+	t.Helper()
+
+	creds, err := auth.New(
+		auth.User{Username: "alice", Password: "secret", Allow: []string{"*"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &api.Dialer{Naming: api.DefaultNaming, Direct: true}
+
+	socks5 = tunneltest.FreeAddr(t)
+	s, err := api.Socks5Server(socks5, d, creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	http = tunneltest.FreeAddr(t)
+	hs, err := api.HTTPServer(http, d, creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { hs.Close() })
+
+	return socks5, http
+}
+
+func echoAddr(t *testing.T) netapi.Address {
+	addr, err := netapi.ParseAddress("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(tunneltest.EchoServer(t)))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+func TestChain(t *testing.T) {
+	socks5, http := proxies(t)
+	echo := echoAddr(t)
+
+	host, port, _ := net.SplitHostPort(socks5)
+	node := `{"protocols": [{"simple": {"host": "` + host + `", "port": ` + port + `}}, {"socks5": {"user": "alice", "password": "secret"}}]}`
+
+	for _, urls := range [][]string{
+		{"socks5://alice:secret@" + socks5},
+		{"http://alice:secret@" + http},
+		{"socks5://alice:secret@" + socks5, "http://alice:secret@" + http},
+		{"http://alice:secret@" + http, "socks5h://alice:secret@" + socks5},
+		{"http://alice:secret@" + http, node},
+	} {
+		p, err := upstream.ParseChain(urls...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := p.Conn(context.Background(), echo)
+		if err != nil {
+			t.Fatalf("%v: %v", urls, err)
+		}
+		tunneltest.AssertEcho(t, conn)
+		conn.Close()
+	}
+
+	for _, urls := range [][]string{
+		{"socks5://alice:wrong@" + socks5},
+		{"http://alice:wrong@" + http},
+		{"socks5://alice:secret@" + socks5, "http://" + http},
+	} {
+		p, err := upstream.ParseChain(urls...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if conn, err := p.Conn(context.Background(), echo); err == nil {
+			conn.Close()
+			t.Errorf("%v: expect auth error", urls)
+		}
+	}
+
+	if _, err := upstream.Parse("ftp://" + socks5); err == nil {
+		t.Error("expect unsupported scheme")
+	}
+	if _, err := upstream.Parse(`{"protocols": [{"socks6": {}}]}`); err == nil {
+		t.Error("expect unknown protocol")
+	}
+}
+
+func TestFromEnvironment(t *testing.T) {
+	socks5, _ := proxies(t)
+
+	t.Setenv("HTTPS_PROXY", "")
+	t.Setenv("https_proxy", "")
+	t.Setenv("ALL_PROXY", "socks5://alice:secret@"+socks5)
+	t.Setenv("NO_PROXY", "internal.example.com")
+
+	if p, err := upstream.FromEnvironment("tunnel.internal.example.com:8388"); err != nil || p != nil {
+		t.Fatalf("NO_PROXY should skip the proxy, got %v %v", p, err)
+	}
+
+	p, err := upstream.FromEnvironment("tunnel.example.com:8388")
+	if err != nil || p == nil {
+		t.Fatalf("expect ALL_PROXY, got %v %v", p, err)
+	}
+
+	conn, err := p.Conn(context.Background(), echoAddr(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunneltest.AssertEcho(t, conn)
+	conn.Close()
+}